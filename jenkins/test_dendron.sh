@@ -15,6 +15,12 @@ go get github.com/constabulary/gb/...
 go get github.com/golang/lint/golint
 go get github.com/tebeka/go2xunit
 
+# The login tests check passwords and issue tokens in a scratch postgres
+# database, on the same server that sytest runs synapse against.
+dropdb --if-exists dendron_test
+createdb dendron_test || exit 1
+export DENDRON_TEST_POSTGRES="postgres:///dendron_test?sslmode=disable"
+
 # TODO: Whatever comes out of https://github.com/constabulary/gb/issues/559
 GOPATH=$(pwd):$(pwd)/vendor go test $(gb list) -v | go2xunit > results.xml
 golint src/... >golint.txt
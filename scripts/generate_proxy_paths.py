@@ -29,7 +29,7 @@ v2_paths = ["/account", "/register", "/rooms/{roomId}/receipt", "/sync", "/token
 media_path_prefixes = ["/download", "/thumbnail", "/upload"]
 
 raw = set()
-redacted = set()
+templated = set()
 
 for file, contents in apis.items():
     for path, methods in contents["paths"].items():
@@ -48,8 +48,11 @@ for file, contents in apis.items():
                 raw.add(r0_path)
                 raw.add(v_path)
             else:
-                redacted.add(re.sub("{[^}]*}", "[^/]*", r0_path))
-                redacted.add(re.sub("{[^}]*}", "[^/]*", v_path))
+                templated.add(r0_path)
+                templated.add(v_path)
+
+def as_regexp(path):
+    return re.sub("{[^}]*}", "[^/]*", path)
 
 with open(outfile, "w") as f:
     f.write( """package proxy
@@ -59,36 +62,16 @@ with open(outfile, "w") as f:
 
 //go:generate python ../../../../../scripts/generate_proxy_paths.py ../../../../../vendor/src/github.com/matrix-org/matrix-doc
 
-import "regexp"
-
-var unknownPath = "unknown path"
-
-type regexpAndString struct {
-	re *regexp.Regexp
-	s  string
-}
-
-var (
-	constantPaths = make(map[string]bool)
-	regexpPaths   []regexpAndString
-)
-
-func endpointFor(path string) string {
-	if ok := constantPaths[path]; ok {
-		return path
-	}
-	for _, i := range regexpPaths {
-		if i.re.MatchString(path) {
-			return i.s
-		}
-	}
-	return unknownPath
-}
-
-func init() {
+// endpointTemplates are the paths of the known endpoints, with path parameters
+// written as {param}. If a path matches more than one template then the one
+// listed first is used.
+var endpointTemplates = []string{
 """)
 
-    f.write('\n'.join('\tconstantPaths[`%s`] = true' % (p,) for p in sorted(raw)))
-    f.write("\n\n")
-    f.write('\n'.join('\tregexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^%s$`), `%s`})' % (p, p.replace("[^/]*", "_")) for p in sorted(redacted)))
-    f.write("\n}\n")
+    # Constant paths are listed before the templated paths so that they take
+    # precedence. The templated paths are ordered as if the parameters were
+    # the regular expressions that the endpoints used to be matched with,
+    # with ties broken by the template itself as readSpecs does in proxy/spec.go.
+    f.write(''.join('\t`%s`,\n' % (p,) for p in sorted(raw)))
+    f.write(''.join('\t`%s`,\n' % (p,) for p in sorted(templated, key=lambda p: (as_regexp(p), p))))
+    f.write("}\n")
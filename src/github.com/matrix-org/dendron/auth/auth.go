@@ -0,0 +1,290 @@
+// Package auth works out which user made a client request from its access
+// token, by asking synapse and caching the answer.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendron/proxy"
+)
+
+// ErrUnknownToken is returned for access tokens that synapse doesn't
+// recognise.
+var ErrUnknownToken = errors.New("auth: unknown access token")
+
+// AccessToken returns the access token from the access_token query parameter
+// or the Authorization header of req, or "" if it doesn't have one.
+func AccessToken(req *http.Request) string {
+	if token := req.URL.Query().Get("access_token"); token != "" {
+		return token
+	}
+	const bearer = "Bearer "
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, bearer) {
+		return auth[len(bearer):]
+	}
+	return ""
+}
+
+type contextKey int
+
+const userIDKey contextKey = 0
+
+// VerifiedUserID returns the ID of the user whose access token was checked by
+// a Resolver's Handler before req reached this handler.
+func VerifiedUserID(req *http.Request) (string, bool) {
+	userID, ok := req.Context().Value(userIDKey).(string)
+	return userID, ok
+}
+
+var (
+	// logoutPath matches the endpoint that invalidates the access token used.
+	logoutPath = proxy.ClientPath(`logout$`)
+	// logoutAllPath matches the endpoint that invalidates all of a user's
+	// access tokens.
+	logoutAllPath = proxy.ClientPath(`logout/all$`)
+	// validatedPath matches the APIs whose access tokens are validated.
+	validatedPath = regexp.MustCompile(`^/_matrix/(client|media)/`)
+)
+
+// A cacheEntry is a cached answer from synapse. The userID is "" if synapse
+// didn't recognise the token.
+type cacheEntry struct {
+	userID  string
+	expires time.Time
+}
+
+// A Resolver looks up the user an access token belongs to with synapse's
+// whoami API. Answers are cached for a while so that most requests don't
+// cost an extra request to synapse.
+// It implements prometheus.Collector to export how lookups were answered.
+type Resolver struct {
+	// UnknownTokenTTL is how long to remember that synapse didn't recognise
+	// an access token, so that a client retrying with a bad token doesn't
+	// cost a request to synapse every time.
+	UnknownTokenTTL time.Duration
+	// Timeout limits how long to wait for synapse to answer a lookup.
+	Timeout time.Duration
+
+	whoamiURL string
+	client    *http.Client
+	ttl       time.Duration
+
+	// mutex makes checking an entry's expiry and removing it atomic with
+	// respect to invalidation.
+	mutex sync.Mutex
+	cache *lru.Cache
+	// invalidations counts calls to Invalidate and InvalidateUser, so that
+	// an answer from synapse that raced with a logout isn't cached.
+	invalidations uint64
+
+	lookups  *prometheus.CounterVec
+	rejected prometheus.Counter
+}
+
+// NewResolver creates a Resolver that asks the synapse at synapseURL using
+// client, and caches up to size answers for ttl.
+func NewResolver(synapseURL *url.URL, client *http.Client, size int, ttl time.Duration) (*Resolver, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{
+		UnknownTokenTTL: 10 * time.Second,
+		Timeout:         10 * time.Second,
+		whoamiURL:       strings.TrimSuffix(synapseURL.String(), "/") + "/_matrix/client/r0/account/whoami",
+		client:          client,
+		cache:           cache,
+		ttl:             ttl,
+		lookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_access_token_lookups_total",
+				Help: "Number of access token lookups by whether they were answered from the cache, by synapse, or failed",
+			},
+			[]string{"result"},
+		),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dendron_access_tokens_rejected_total",
+			Help: "Number of requests refused at the edge because synapse didn't recognise their access token",
+		}),
+	}, nil
+}
+
+// UserID returns the ID of the user that token belongs to.
+func (r *Resolver) UserID(token string) (string, error) {
+	if entry, ok := r.cached(token); ok {
+		r.lookups.WithLabelValues("cached").Inc()
+		if entry.userID == "" {
+			return "", ErrUnknownToken
+		}
+		return entry.userID, nil
+	}
+
+	r.mutex.Lock()
+	invalidations := r.invalidations
+	r.mutex.Unlock()
+	userID, err := r.whoami(token)
+	entry := cacheEntry{userID: userID, expires: time.Now().Add(r.ttl)}
+	if err == ErrUnknownToken {
+		entry.expires = time.Now().Add(r.UnknownTokenTTL)
+	} else if err != nil {
+		r.lookups.WithLabelValues("error").Inc()
+		return "", err
+	}
+	r.lookups.WithLabelValues("synapse").Inc()
+	r.mutex.Lock()
+	if r.invalidations == invalidations && (err == nil || r.UnknownTokenTTL > 0) {
+		r.cache.Add(token, entry)
+	}
+	r.mutex.Unlock()
+	return userID, err
+}
+
+// cached returns the answer cached for token if it hasn't expired.
+func (r *Resolver) cached(token string) (cacheEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	value, ok := r.cache.Get(token)
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := value.(cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		r.cache.Remove(token)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// Invalidate forgets the answer cached for token.
+func (r *Resolver) Invalidate(token string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.invalidations++
+	r.cache.Remove(token)
+}
+
+// InvalidateUser forgets all the access tokens that belong to userID.
+func (r *Resolver) InvalidateUser(userID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.invalidations++
+	for _, token := range r.cache.Keys() {
+		if value, ok := r.cache.Peek(token); ok && value.(cacheEntry).userID == userID {
+			r.cache.Remove(token)
+		}
+	}
+}
+
+// Handler wraps next so that cached access tokens are forgotten when they are
+// logged out. If validate is set, requests to the client and media APIs with
+// access tokens that synapse doesn't recognise are refused with
+// M_UNKNOWN_TOKEN, and the user of the others is available to later handlers
+// from VerifiedUserID. Requests whose tokens can't be checked, e.g. because
+// synapse is unavailable, are passed on for synapse to deal with.
+func (r *Resolver) Handler(validate bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := AccessToken(req)
+		if token == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		var userID string
+		var err error
+		logoutAll := req.Method == "POST" && logoutAllPath.MatchString(req.URL.Path)
+		if logoutAll || (validate && validatedPath.MatchString(req.URL.Path)) {
+			// The user has to be looked up before logging out, since the
+			// token stops working afterwards.
+			userID, err = r.UserID(token)
+		}
+		if err == ErrUnknownToken && validate {
+			r.rejected.Inc()
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        err,
+				StatusCode: 401,
+				ErrCode:    "M_UNKNOWN_TOKEN",
+				Message:    "Unrecognised access token",
+			})
+			return
+		}
+		if err != nil && err != ErrUnknownToken {
+			log.WithFields(log.Fields{
+				"path":  req.URL.Path,
+				"error": err,
+			}).Warn("Failed to check access token")
+		}
+		if userID != "" {
+			req = req.WithContext(context.WithValue(req.Context(), userIDKey, userID))
+		}
+
+		next.ServeHTTP(w, req)
+
+		if req.Method != "POST" {
+			return
+		}
+		if logoutAll && userID != "" {
+			r.InvalidateUser(userID)
+		} else if logoutPath.MatchString(req.URL.Path) {
+			r.Invalidate(token)
+		}
+	})
+}
+
+func (r *Resolver) whoami(token string) (string, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", r.whoamiURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		UserID  string `json:"user_id"`
+		ErrCode string `json:"errcode"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("auth: decoding whoami response: %v", err)
+	}
+	if resp.StatusCode == 401 && body.ErrCode == "M_UNKNOWN_TOKEN" {
+		return "", ErrUnknownToken
+	}
+	if resp.StatusCode != 200 || body.UserID == "" {
+		return "", fmt.Errorf("auth: whoami failed with %d %s", resp.StatusCode, body.ErrCode)
+	}
+	return body.UserID, nil
+}
+
+// Describe implements prometheus.Collector
+func (r *Resolver) Describe(ch chan<- *prometheus.Desc) {
+	r.lookups.Describe(ch)
+	r.rejected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (r *Resolver) Collect(ch chan<- prometheus.Metric) {
+	r.lookups.Collect(ch)
+	r.rejected.Collect(ch)
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSynapse answers whoami requests for "alice_token" and counts them.
+func fakeSynapse(t *testing.T, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/client/r0/account/whoami" {
+			t.Errorf("unexpected request for %s", req.URL.Path)
+		}
+		*calls++
+		if AccessToken(req) != "alice_token" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unrecognised access token"}`))
+			return
+		}
+		w.Write([]byte(`{"user_id":"@alice:example.org"}`))
+	}))
+}
+
+func newResolver(t *testing.T, s *httptest.Server, ttl time.Duration) *Resolver {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(u, http.DefaultClient, 10, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestResolver(t *testing.T) {
+	var calls int
+	s := fakeSynapse(t, &calls)
+	defer s.Close()
+	r := newResolver(t, s, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		userID, err := r.UserID("alice_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userID != "@alice:example.org" {
+			t.Errorf("want @alice:example.org got %s", userID)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("want one whoami request got %d", calls)
+	}
+
+	// Unknown tokens are remembered for a short while too.
+	for i := 0; i < 2; i++ {
+		if _, err := r.UserID("bad_token"); err != ErrUnknownToken {
+			t.Errorf("want ErrUnknownToken got %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("want the unknown token looked up once got %d requests", calls-1)
+	}
+	r.Invalidate("bad_token")
+	if _, err := r.UserID("bad_token"); err != ErrUnknownToken || calls != 3 {
+		t.Errorf("want the invalidated token looked up again got %v after %d requests", err, calls)
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+	r := newResolver(t, s, time.Hour)
+	r.Timeout = 10 * time.Millisecond
+
+	if _, err := r.UserID("alice_token"); err == nil || err == ErrUnknownToken {
+		t.Errorf("want a timeout error got %v", err)
+	}
+}
+
+func TestResolverExpiry(t *testing.T) {
+	var calls int
+	s := fakeSynapse(t, &calls)
+	defer s.Close()
+	r := newResolver(t, s, time.Nanosecond)
+
+	r.UserID("alice_token")
+	time.Sleep(time.Millisecond)
+	r.UserID("alice_token")
+	if calls != 2 {
+		t.Errorf("want the expired answer looked up again got %d requests", calls)
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	req := httptest.NewRequest("GET", "/_matrix/client/r0/sync?access_token=query_token", nil)
+	req.Header.Set("Authorization", "Bearer header_token")
+	if got := AccessToken(req); got != "query_token" {
+		t.Errorf("want query_token got %q", got)
+	}
+	req = httptest.NewRequest("GET", "/_matrix/client/r0/sync", nil)
+	req.Header.Set("Authorization", "Bearer header_token")
+	if got := AccessToken(req); got != "header_token" {
+		t.Errorf("want header_token got %q", got)
+	}
+	req.Header.Set("Authorization", "Basic Zm9v")
+	if got := AccessToken(req); got != "" {
+		t.Errorf("want no token got %q", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var calls int
+	s := fakeSynapse(t, &calls)
+	defer s.Close()
+	r := newResolver(t, s, time.Hour)
+
+	var gotUserID string
+	h := r.Handler(true, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotUserID, _ = VerifiedUserID(req)
+	}))
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		gotUserID = ""
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("GET", "/_matrix/client/r0/sync", "alice_token"); w.Code != 200 || gotUserID != "@alice:example.org" {
+		t.Errorf("valid token: got %d for %q", w.Code, gotUserID)
+	}
+	w := request("GET", "/_matrix/client/r0/sync", "bad_token")
+	if w.Code != 401 || !strings.Contains(w.Body.String(), "M_UNKNOWN_TOKEN") {
+		t.Errorf("unknown token: want 401 M_UNKNOWN_TOKEN got %d %s", w.Code, w.Body)
+	}
+	if w := request("GET", "/_matrix/federation/v1/version", "bad_token"); w.Code != 200 {
+		t.Errorf("outside the client API: want 200 got %d", w.Code)
+	}
+	if w := request("GET", "/_matrix/client/r0/sync", ""); w.Code != 200 || gotUserID != "" {
+		t.Errorf("no token: got %d for %q", w.Code, gotUserID)
+	}
+
+	request("POST", "/_matrix/client/r0/logout", "alice_token")
+	if _, ok := r.cached("alice_token"); ok {
+		t.Error("want the token forgotten after logout")
+	}
+	r.UserID("alice_token")
+	request("POST", "/_matrix/client/r0/logout/all", "alice_token")
+	if _, ok := r.cached("alice_token"); ok {
+		t.Error("want the token forgotten after logging out everywhere")
+	}
+	r.UserID("alice_token")
+	request("POST", "/_matrix/client/api/v1/logout", "alice_token")
+	if _, ok := r.cached("alice_token"); ok {
+		t.Error("want the token forgotten after logout through api/v1")
+	}
+}
+
+func TestInvalidateUser(t *testing.T) {
+	r, err := NewResolver(&url.URL{}, http.DefaultClient, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	r.cache.Add("a1", cacheEntry{userID: "@a:b", expires: expires})
+	r.cache.Add("a2", cacheEntry{userID: "@a:b", expires: expires})
+	r.cache.Add("c1", cacheEntry{userID: "@c:d", expires: expires})
+	r.InvalidateUser("@a:b")
+	if keys := r.cache.Keys(); len(keys) != 1 || keys[0] != "c1" {
+		t.Errorf("want only c1 left got %v", keys)
+	}
+}
@@ -0,0 +1,119 @@
+// Package bodylimit caps the size of request bodies by route so that clients
+// can't make dendron stream arbitrarily large bodies to synapse.
+package bodylimit
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendron/proxy"
+)
+
+// A route is a group of endpoints that share a body size limit.
+type route struct {
+	name string
+	path *regexp.Regexp
+}
+
+// routes are checked in order, so more specific routes come first.
+var routes = []route{
+	{"upload", proxy.UploadPath},
+	{"event", proxy.ClientPath(`rooms/[^/]+/(send|state|redact)/`)},
+	{"client", regexp.MustCompile(`^/_matrix/client/`)},
+}
+
+// Limits are the largest bodies allowed for each route, in bytes. Zero means
+// no limit.
+type Limits struct {
+	// Upload is for media uploads.
+	Upload int64
+	// Event is for endpoints that send an event.
+	Event int64
+	// Client is for the rest of the client-server API.
+	Client int64
+}
+
+// A Limiter refuses requests with bodies that are too large for their route.
+// Requests that declare their length with Content-Length are refused before
+// any of the body is read. Others are cut off once they reach the limit.
+// It implements prometheus.Collector to export how many requests were refused.
+type Limiter struct {
+	limits   map[string]int64
+	rejected *prometheus.CounterVec
+}
+
+// NewLimiter creates a Limiter that applies limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits: map[string]int64{
+			"upload": limits.Upload,
+			"event":  limits.Event,
+			"client": limits.Client,
+		},
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_request_bodies_too_large_total",
+				Help: "Number of requests refused because their body was too large, by route and whether the Content-Length was too large or the body was cut off while it was streamed",
+			},
+			[]string{"route", "check"},
+		),
+	}
+}
+
+// limitFor returns the route that path belongs to and its limit, or a limit
+// of zero if it has none.
+func (l *Limiter) limitFor(path string) (string, int64) {
+	for _, r := range routes {
+		if r.path.MatchString(path) {
+			return r.name, l.limits[r.name]
+		}
+	}
+	return "", 0
+}
+
+// Handler wraps next so that requests with bodies over the limit for their
+// route are refused with M_TOO_LARGE.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name, limit := l.limitFor(req.URL.Path)
+		if limit <= 0 || req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.ContentLength > limit {
+			l.rejected.WithLabelValues(name, "content_length").Inc()
+			ReplyTooLarge(w, fmt.Errorf("content length %d is over the %d byte limit for %s", req.ContentLength, limit, name))
+			return
+		}
+		// The proxy replies with M_TOO_LARGE when reading the body fails
+		// with an *http.MaxBytesError.
+		req.Body = &proxy.CountingReader{
+			ReadCloser: http.MaxBytesReader(w, req.Body, limit),
+			OnLimit:    func() { l.rejected.WithLabelValues(name, "stream").Inc() },
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ReplyTooLarge writes an M_TOO_LARGE error to w.
+func ReplyTooLarge(w http.ResponseWriter, err error) {
+	proxy.LogAndReplyError(w, &proxy.HTTPError{
+		Err:        err,
+		StatusCode: 413,
+		ErrCode:    "M_TOO_LARGE",
+		Message:    "Request body too large",
+	})
+}
+
+// Describe implements prometheus.Collector
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.rejected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.rejected.Collect(ch)
+}
@@ -0,0 +1,79 @@
+package bodylimit
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(Limits{Upload: 100, Event: 10, Client: 20})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			ReplyTooLarge(w, err)
+		}
+	}))
+
+	for _, test := range []struct {
+		method, path string
+		size         int
+		chunked      bool
+		want         int
+	}{
+		{"POST", "/_matrix/media/r0/upload", 100, false, 200},
+		{"POST", "/_matrix/media/r0/upload", 101, false, 413},
+		{"POST", "/_matrix/media/r0/upload", 101, true, 413},
+		{"POST", "/_matrix/media/api/v1/upload", 101, false, 413},
+		{"PUT", "/_matrix/media/v3/upload/example.org/abc", 101, false, 413},
+		{"PUT", "/_matrix/client/r0/rooms/!a:b/send/m.room.message/1", 10, true, 200},
+		{"PUT", "/_matrix/client/r0/rooms/!a:b/send/m.room.message/1", 11, false, 413},
+		{"PUT", "/_matrix/client/r0/rooms/!a:b/state/m.room.topic/", 11, true, 413},
+		{"PUT", "/_matrix/client/api/v1/rooms/!a:b/send/m.room.message/1", 10, false, 200},
+		{"PUT", "/_matrix/client/api/v1/rooms/!a:b/send/m.room.message/1", 11, true, 413},
+		{"POST", "/_matrix/client/r0/createRoom", 20, false, 200},
+		{"POST", "/_matrix/client/r0/createRoom", 21, true, 413},
+		{"PUT", "/_matrix/federation/v1/send/1/", 1000, false, 200},
+	} {
+		var body io.Reader = strings.NewReader(strings.Repeat("x", test.size))
+		if test.chunked {
+			// Hide the length so that it isn't known up front.
+			body = ioutil.NopCloser(body)
+		}
+		req := httptest.NewRequest(test.method, test.path, body)
+		if test.chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s %s with %d bytes: want %d got %d", test.method, test.path, test.size, test.want, w.Code)
+			continue
+		}
+		if test.want == 413 {
+			var resp struct {
+				ErrCode string `json:"errcode"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.ErrCode != "M_TOO_LARGE" {
+				t.Errorf("%s %s: want M_TOO_LARGE got %s", test.method, test.path, w.Body)
+			}
+		}
+	}
+}
+
+func TestLimiterContentLength(t *testing.T) {
+	l := NewLimiter(Limits{Client: 20})
+	called := false
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	req := httptest.NewRequest("POST", "/_matrix/client/r0/login", strings.NewReader(strings.Repeat("x", 21)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if called || w.Code != 413 {
+		t.Errorf("want the request refused up front got %d, called %v", w.Code, called)
+	}
+}
@@ -0,0 +1,219 @@
+// Package certs serves TLS certificates that are reloaded from disk when they
+// change, choosing between several certificates by the server name the client
+// asks for.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/fsnotify.v1"
+)
+
+// reloadDelay is how long to wait after a change before reloading, so that
+// a certificate and key written one after the other are loaded together.
+const reloadDelay = 500 * time.Millisecond
+
+// A Pair is the paths of a PEM encoded certificate chain and its private key.
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certSet is a loaded set of certificates indexed by the names they are for.
+type certSet struct {
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// A Store holds the certificates for a listener. Its GetCertificate method is
+// used as the tls.Config's GetCertificate so that reloaded certificates are
+// used for new connections straight away.
+// It implements prometheus.Collector to export when the certificates expire
+// and the results of reloading them.
+type Store struct {
+	pairs   []Pair
+	current atomic.Value // *certSet
+	watcher *fsnotify.Watcher
+
+	expiry  *prometheus.GaugeVec
+	reloads *prometheus.CounterVec
+}
+
+// NewStore loads the certificates. The first pair is used for clients that
+// don't ask for a server name that one of the certificates is for.
+func NewStore(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("certs: no certificates")
+	}
+	s := &Store{
+		pairs: pairs,
+		expiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "dendron_tls_certificate_expiry_timestamp_seconds",
+				Help: "The time that the TLS certificates being served expire, in seconds since the epoch",
+			},
+			[]string{"cert_file"},
+		),
+		reloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_tls_certificate_reloads_total",
+				Help: "Number of times the TLS certificates were reloaded by whether the reload succeeded",
+			},
+			[]string{"result"},
+		),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the certificates from disk again. If any of them fail to load
+// then the certificates already loaded are kept.
+func (s *Store) Reload() error {
+	set, err := load(s.pairs)
+	if err != nil {
+		s.reloads.WithLabelValues("failure").Inc()
+		return err
+	}
+	s.current.Store(set)
+	s.reloads.WithLabelValues("success").Inc()
+	for i, cert := range set.certs {
+		s.expiry.WithLabelValues(s.pairs[i].CertFile).Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+	return nil
+}
+
+func load(pairs []Pair) (*certSet, error) {
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("certs: loading %s: %v", pair.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, fmt.Errorf("certs: parsing %s: %v", pair.CertFile, err)
+			}
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// Earlier pairs take precedence if they are for the same name.
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = &cert
+			}
+		}
+		set.certs = append(set.certs, &cert)
+	}
+	return set, nil
+}
+
+// certificate returns the certificate for serverName, falling back to a
+// wildcard certificate for its parent domain and then the default.
+func (set *certSet) certificate(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := set.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return set.certs[0]
+}
+
+// GetCertificate returns the certificate for the server name in hello.
+// It has the signature of tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load().(*certSet).certificate(hello.ServerName), nil
+}
+
+// Watch reloads the certificates whenever the files change until Close is
+// called. The directories holding the files are watched, rather than the
+// files themselves, so that files replaced by renaming a new file over them,
+// or by swapping a symlink, are noticed.
+func (s *Store) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, pair := range s.pairs {
+		dirs[filepath.Dir(pair.CertFile)] = true
+		dirs[filepath.Dir(pair.KeyFile)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	s.watcher = watcher
+	go s.watch(watcher)
+	return nil
+}
+
+func (s *Store) watch(watcher *fsnotify.Watcher) {
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Chmod == event.Op {
+				continue
+			}
+			if reload == nil {
+				reload = time.After(reloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Print("Error watching TLS certificates")
+		case <-reload:
+			reload = nil
+			if err := s.Reload(); err != nil {
+				log.WithError(err).Warn("Failed to reload TLS certificates, keeping the old ones")
+			} else {
+				log.Print("Reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+// Close stops watching the certificates for changes.
+func (s *Store) Close() error {
+	if s.watcher == nil {
+		return nil
+	}
+	return s.watcher.Close()
+}
+
+// Describe implements prometheus.Collector
+func (s *Store) Describe(ch chan<- *prometheus.Desc) {
+	s.expiry.Describe(ch)
+	s.reloads.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (s *Store) Collect(ch chan<- prometheus.Metric) {
+	s.expiry.Collect(ch)
+	s.reloads.Collect(ch)
+}
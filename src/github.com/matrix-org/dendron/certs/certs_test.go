@@ -0,0 +1,140 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for names that expires at
+// notAfter, and its key, to dir.
+func writePair(t *testing.T, dir, name string, notAfter time.Time, names ...string) Pair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := Pair{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	// Write the key first, then replace the certificate by renaming over it
+	// as certificate renewal tools do.
+	if err := ioutil.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tmp := pair.CertFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, pair.CertFile); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func leafFor(t *testing.T, s *Store, serverName string) *x509.Certificate {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf
+}
+
+func TestSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expiry := time.Now().Add(24 * time.Hour)
+	s, err := NewStore([]Pair{
+		writePair(t, dir, "server", expiry, "example.org"),
+		writePair(t, dir, "client", expiry, "matrix.example.org"),
+		writePair(t, dir, "wildcard", expiry, "*.example.com"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, want := range map[string]string{
+		"example.org":         "example.org",
+		"MATRIX.example.org.": "matrix.example.org",
+		"chat.example.com":    "*.example.com",
+		"example.net":         "example.org",
+		"":                    "example.org",
+	} {
+		if got := leafFor(t, s, serverName).DNSNames[0]; got != want {
+			t.Errorf("%q: want the certificate for %s got %s", serverName, want, got)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore([]Pair{writePair(t, dir, "server", time.Now().Add(time.Hour), "example.org")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	renewed := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	writePair(t, dir, "server", renewed, "example.org")
+	deadline := time.Now().Add(10 * time.Second)
+	for !leafFor(t, s, "example.org").NotAfter.Equal(renewed) {
+		if time.Now().After(deadline) {
+			t.Fatal("want the renewed certificate to be loaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReloadFailureKeepsCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pair := writePair(t, dir, "server", time.Now().Add(time.Hour), "example.org")
+	s, err := NewStore([]Pair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.CertFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("want an error reloading an invalid certificate")
+	}
+	if leafFor(t, s, "example.org") == nil {
+		t.Error("want the old certificate to still be served")
+	}
+}
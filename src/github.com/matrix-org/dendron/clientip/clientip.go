@@ -0,0 +1,201 @@
+// Package clientip works out the address of the client that made a request
+// when dendron is behind one or more trusted proxies or load balancers.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The headers that proxies use to tell the next hop who the client was.
+// They are removed from every request and replaced with X-Forwarded-For and
+// X-Real-IP headers holding the client address that dendron derived.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"}
+
+type contextKey struct{}
+
+// A Resolver derives the address of the client that made a request from the
+// address of the peer that connected to dendron and the X-Forwarded-For
+// headers added by any trusted proxies in front of it.
+// It implements prometheus.Collector to export how addresses were derived.
+type Resolver struct {
+	trusted []*net.IPNet
+	sources *prometheus.CounterVec
+}
+
+// NewResolver creates a Resolver which trusts the X-Forwarded-For headers sent
+// by peers in the given CIDR ranges. Single IP addresses are also accepted.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{
+		sources: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_client_ip_source_total",
+				Help: "Number of requests by where their client IP was taken from: " +
+					"the peer address, a trusted X-Forwarded-For header, or the peer address after discarding an untrusted header",
+			},
+			[]string{"source"},
+		),
+	}
+	trusted, err := ParseNetworks(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	r.trusted = trusted
+	return r, nil
+}
+
+// ParseNetworks parses a list of CIDR ranges and single IP addresses. Blank
+// entries are skipped.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %v", cidr, err)
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+// IsTrusted returns whether ip is one of the trusted proxies.
+func (r *Resolver) IsTrusted(ip net.IP) bool {
+	for _, ipNet := range r.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where a client IP was taken from, for metrics.
+const (
+	sourcePeer      = "peer"
+	sourceForwarded = "forwarded"
+	sourceSpoofed   = "spoofed"
+)
+
+// resolve returns the client IP for the request and where it was taken from.
+// The X-Forwarded-For hops are walked from the right, starting at the peer,
+// for as long as the address reached belongs to a trusted proxy. Peers that
+// connected over a unix socket are trusted since only local processes allowed
+// by the socket's permissions can connect to it.
+func (r *Resolver) resolve(req *http.Request) (net.IP, string) {
+	peer := parseHop(req.RemoteAddr)
+	var hops []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	trusted := isUnixSocket(req) || (peer != nil && r.IsTrusted(peer))
+	if !trusted {
+		if len(hops) > 0 || req.Header.Get("X-Real-IP") != "" || req.Header.Get("Forwarded") != "" {
+			return peer, sourceSpoofed
+		}
+		return peer, sourcePeer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0 && trusted; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// A trusted proxy passed on something that isn't an address so
+			// treat that proxy as the client.
+			break
+		}
+		client = hop
+		trusted = r.IsTrusted(client)
+	}
+	if client == nil || client.Equal(peer) {
+		return client, sourcePeer
+	}
+	return client, sourceForwarded
+}
+
+// isUnixSocket returns whether the request was received on a unix socket.
+func isUnixSocket(req *http.Request) bool {
+	_, ok := req.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
+
+// parseHop parses an address from an X-Forwarded-For header or the
+// RemoteAddr of a request, either of which may include a port.
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(strings.Trim(hop, "[]")); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(hop)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Handler wraps next so that the requests it handles have their RemoteAddr set
+// to the client's address and any forwarding headers replaced with ones naming
+// the client. The httputil.ReverseProxy then forwards the client address to
+// the backend in X-Forwarded-For.
+func (r *Resolver) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip, source := r.resolve(req)
+		r.sources.WithLabelValues(source).Inc()
+		for _, header := range forwardingHeaders {
+			req.Header.Del(header)
+		}
+		if ip != nil {
+			if source == sourceForwarded {
+				// The client's port isn't known once it is behind a proxy
+				// but RemoteAddr is expected to be host:port.
+				req.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			}
+			req.Header.Set("X-Real-IP", ip.String())
+			req = req.WithContext(context.WithValue(req.Context(), contextKey{}, ip))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// FromRequest returns the client IP for a request that has been through a
+// Resolver's Handler, or the host part of the request's RemoteAddr otherwise.
+func FromRequest(req *http.Request) string {
+	if ip, ok := req.Context().Value(contextKey{}).(net.IP); ok {
+		return ip.String()
+	}
+	if ip := parseHop(req.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+// Describe implements prometheus.Collector
+func (r *Resolver) Describe(ch chan<- *prometheus.Desc) {
+	r.sources.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (r *Resolver) Collect(ch chan<- prometheus.Metric) {
+	r.sources.Collect(ch)
+}
@@ -0,0 +1,76 @@
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	r, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		unix       bool
+		xff        []string
+		wantIP     string
+		wantSource string
+	}{
+		{"direct", "203.0.113.5:1234", false, nil, "203.0.113.5", sourcePeer},
+		{"spoofed", "203.0.113.5:1234", false, []string{"1.2.3.4"}, "203.0.113.5", sourceSpoofed},
+		{"trusted lb", "10.1.2.3:1234", false, []string{"198.51.100.7"}, "198.51.100.7", sourceForwarded},
+		{"chain of trusted proxies", "192.168.1.1:1234", false, []string{"1.2.3.4, 198.51.100.7, 10.9.9.9"}, "198.51.100.7", sourceForwarded},
+		{"multiple headers", "10.1.2.3:1234", false, []string{"1.2.3.4", "198.51.100.7:555"}, "198.51.100.7", sourceForwarded},
+		{"ipv6 client", "10.1.2.3:1234", false, []string{"[2001:db8::1]:443"}, "2001:db8::1", sourceForwarded},
+		{"garbage from trusted lb", "10.1.2.3:1234", false, []string{"unknown"}, "10.1.2.3", sourcePeer},
+		{"trusted lb without header", "10.1.2.3:1234", false, nil, "10.1.2.3", sourcePeer},
+		{"unix socket proxy", "@", true, []string{"198.51.100.7"}, "198.51.100.7", sourceForwarded},
+		{"unix socket proxy chain", "@", true, []string{"1.2.3.4, 198.51.100.7, 10.9.9.9"}, "198.51.100.7", sourceForwarded},
+	} {
+		var got *http.Request
+		h := r.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = req
+		}))
+		req := httptest.NewRequest("GET", "/_matrix/client/r0/sync", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.unix {
+			addr := &net.UnixAddr{Name: "/run/dendron.sock", Net: "unix"}
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, addr))
+		}
+		for _, xff := range tc.xff {
+			req.Header.Add("X-Forwarded-For", xff)
+			req.Header.Set("Forwarded", "for=1.2.3.4")
+		}
+		if _, source := r.resolve(req); source != tc.wantSource {
+			t.Errorf("%s: source: want %q got %q", tc.name, tc.wantSource, source)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if ip := FromRequest(got); ip != tc.wantIP {
+			t.Errorf("%s: client IP: want %q got %q", tc.name, tc.wantIP, ip)
+		}
+		if xff := got.Header.Get("X-Forwarded-For"); xff != "" {
+			t.Errorf("%s: want X-Forwarded-For removed got %q", tc.name, xff)
+		}
+		if fwd := got.Header.Get("Forwarded"); fwd != "" {
+			t.Errorf("%s: want Forwarded removed got %q", tc.name, fwd)
+		}
+		if realIP := got.Header.Get("X-Real-IP"); realIP != tc.wantIP {
+			t.Errorf("%s: X-Real-IP: want %q got %q", tc.name, tc.wantIP, realIP)
+		}
+	}
+}
+
+func TestNewResolverInvalid(t *testing.T) {
+	for _, cidr := range []string{"not an ip", "10.0.0.0/33"} {
+		if _, err := NewResolver([]string{cidr}); err == nil {
+			t.Errorf("NewResolver(%q): want error", cidr)
+		}
+	}
+}
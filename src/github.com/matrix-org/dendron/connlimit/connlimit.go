@@ -0,0 +1,251 @@
+// Package connlimit limits how many client connections dendron holds open, in
+// total and from any one address, so that a misbehaving client can't use up
+// all of its file descriptors.
+package connlimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errPerIPLimit is returned when using a connection whose client turned out
+// to be over the per IP limit once its PROXY header was read.
+var errPerIPLimit = errors.New("connlimit: too many connections from the client's address")
+
+// A proxiedConn is a connection which may get its RemoteAddr from a PROXY
+// protocol header, like a *proxyprotocol.Conn.
+type proxiedConn interface {
+	// PeerAddr returns the address of the peer without waiting for the
+	// header.
+	PeerAddr() net.Addr
+}
+
+// A Listener wraps a net.Listener so that connections over the limits are
+// closed as soon as they are accepted.
+//
+// If the listener accepts connections through the PROXY protocol then the
+// per IP limit applies to the client address in the PROXY header. Since the
+// header isn't read until the connection is first used, connections from
+// exempt proxies are checked against the per IP limit then instead.
+// It implements prometheus.Collector to export how many connections were
+// accepted, rejected and are open.
+type Listener struct {
+	net.Listener
+	// Max is the most connections open at once. Zero means no limit.
+	Max int
+	// MaxPerIP is the most connections open at once from an IP address.
+	// Zero means no limit.
+	MaxPerIP int
+	// Exempt reports whether connections from an IP address aren't subject
+	// to MaxPerIP, e.g. because it is a load balancer.
+	Exempt func(net.IP) bool
+
+	mutex  sync.Mutex
+	active int
+	perIP  map[string]int
+
+	accepted prometheus.Counter
+	rejected *prometheus.CounterVec
+	open     prometheus.Gauge
+}
+
+// NewListener wraps inner to limit the connections it accepts.
+func NewListener(inner net.Listener, max, maxPerIP int, exempt func(net.IP) bool) *Listener {
+	return &Listener{
+		Listener: inner,
+		Max:      max,
+		MaxPerIP: maxPerIP,
+		Exempt:   exempt,
+		perIP:    make(map[string]int),
+		accepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dendron_connections_accepted_total",
+			Help: "Number of client connections accepted",
+		}),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_connections_rejected_total",
+				Help: "Number of client connections closed because they were over the total or per IP limit",
+			},
+			[]string{"limit"},
+		),
+		open: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dendron_connections_active",
+			Help: "Number of client connections open",
+		}),
+	}
+}
+
+// Accept returns the next connection that is within the limits.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// A proxied connection's RemoteAddr waits for the PROXY header, so
+		// the limits are checked against the peer it came from.
+		var peer net.Addr
+		proxied, isProxied := c.(proxiedConn)
+		if isProxied {
+			peer = proxied.PeerAddr()
+		} else {
+			peer = c.RemoteAddr()
+		}
+		lc := &conn{Conn: c, listener: l}
+		ip := l.limitedIP(peer)
+		if limit := l.acquire(lc, ip); limit != "" {
+			l.reject(peer, limit)
+			c.Close()
+			continue
+		}
+		// The client behind an exempt proxy is only known once the
+		// PROXY header has been read.
+		lc.deferred = isProxied && ip == ""
+		l.accepted.Inc()
+		return lc, nil
+	}
+}
+
+// reject counts and logs a connection from peer over limit. It is given the
+// address rather than the connection since a proxied connection's RemoteAddr
+// waits for the PROXY header, which mustn't hold up Accept.
+func (l *Listener) reject(peer net.Addr, limit string) {
+	l.rejected.WithLabelValues(limit).Inc()
+	log.WithFields(log.Fields{
+		"peer":  peer.String(),
+		"limit": limit,
+	}).Print("Rejecting connection over the limit")
+}
+
+// acquire counts a new connection from ip, or returns which limit it would
+// exceed.
+func (l *Listener) acquire(c *conn, ip string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.Max > 0 && l.active >= l.Max {
+		return "total"
+	}
+	if ip != "" && l.MaxPerIP > 0 && l.perIP[ip] >= l.MaxPerIP {
+		return "per_ip"
+	}
+	l.active++
+	if ip != "" {
+		c.ip = ip
+		l.perIP[ip]++
+	}
+	l.open.Inc()
+	return ""
+}
+
+// acquireIP counts an open connection against the limit for ip once its
+// client is known, or returns "per_ip" if it would exceed it.
+func (l *Listener) acquireIP(c *conn, ip string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if ip == "" || c.closed {
+		return ""
+	}
+	if l.MaxPerIP > 0 && l.perIP[ip] >= l.MaxPerIP {
+		return "per_ip"
+	}
+	c.ip = ip
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *Listener) release(c *conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	c.closed = true
+	l.active--
+	if c.ip != "" {
+		if l.perIP[c.ip]--; l.perIP[c.ip] <= 0 {
+			delete(l.perIP, c.ip)
+		}
+	}
+	l.open.Dec()
+}
+
+// limitedIP returns the IP address that the per IP limit applies to for a
+// peer, or "" if it isn't limited.
+func (l *Listener) limitedIP(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || (l.Exempt != nil && l.Exempt(tcpAddr.IP)) {
+		return ""
+	}
+	return tcpAddr.IP.String()
+}
+
+type conn struct {
+	net.Conn
+	listener *Listener
+	// deferred is set if the connection is checked against the per IP limit
+	// when it is first used.
+	deferred   bool
+	clientOnce sync.Once
+	err        error
+	once       sync.Once
+	// ip and closed are protected by the listener's mutex.
+	ip     string
+	closed bool
+}
+
+// limitClient checks the client of a deferred connection against the per IP
+// limit, closing the connection if it is over.
+func (c *conn) limitClient() error {
+	if !c.deferred {
+		return nil
+	}
+	c.clientOnce.Do(func() {
+		// This waits for the PROXY header if there is one.
+		client := c.Conn.RemoteAddr()
+		ip := c.listener.limitedIP(client)
+		if limit := c.listener.acquireIP(c, ip); limit != "" {
+			c.listener.reject(client, limit)
+			c.err = errPerIPLimit
+			c.Close()
+		}
+	})
+	return c.err
+}
+
+// Read implements net.Conn
+func (c *conn) Read(b []byte) (int, error) {
+	if err := c.limitClient(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Write implements net.Conn
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.limitClient(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// Close implements net.Conn
+func (c *conn) Close() error {
+	c.once.Do(func() { c.listener.release(c) })
+	return c.Conn.Close()
+}
+
+// Describe implements prometheus.Collector
+func (l *Listener) Describe(ch chan<- *prometheus.Desc) {
+	l.accepted.Describe(ch)
+	l.rejected.Describe(ch)
+	l.open.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Listener) Collect(ch chan<- prometheus.Metric) {
+	l.accepted.Collect(ch)
+	l.rejected.Collect(ch)
+	l.open.Collect(ch)
+}
@@ -0,0 +1,174 @@
+package connlimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/matrix-org/dendron/proxyprotocol"
+)
+
+// closedByServer returns whether the server closed c without writing to it.
+func closedByServer(t *testing.T, c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	if err == io.EOF {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	t.Fatalf("unexpected read error %v", err)
+	return false
+}
+
+func rejected(l *Listener, limit string) float64 {
+	var m dto.Metric
+	l.rejected.WithLabelValues(limit).Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func serve(t *testing.T, max, maxPerIP int, exempt func(net.IP) bool) (*Listener, chan net.Conn) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveListener(NewListener(inner, max, maxPerIP, exempt))
+}
+
+func serveListener(l *Listener) (*Listener, chan net.Conn) {
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	return l, accepted
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPerIPLimit(t *testing.T) {
+	l, accepted := serve(t, 0, 2, nil)
+	defer l.Close()
+
+	c1, c2 := dial(t, l), dial(t, l)
+	defer c1.Close()
+	defer c2.Close()
+	server1, server2 := <-accepted, <-accepted
+	defer server2.Close()
+
+	c3 := dial(t, l)
+	defer c3.Close()
+	if !closedByServer(t, c3) {
+		t.Error("want the third connection from an IP closed")
+	}
+	if rejected(l, "per_ip") != 1 {
+		t.Errorf("want one per_ip rejection got %v", rejected(l, "per_ip"))
+	}
+
+	// Closing a connection makes room for another.
+	server1.Close()
+	c4 := dial(t, l)
+	defer c4.Close()
+	if closedByServer(t, c4) {
+		t.Error("want a connection accepted after one was closed")
+	}
+}
+
+func TestTotalLimit(t *testing.T) {
+	// Loopback is exempt from the per IP limit so only the total applies.
+	l, accepted := serve(t, 1, 1, func(ip net.IP) bool { return ip.IsLoopback() })
+	defer l.Close()
+
+	c1 := dial(t, l)
+	defer c1.Close()
+	server1 := <-accepted
+	defer server1.Close()
+
+	c2 := dial(t, l)
+	defer c2.Close()
+	if !closedByServer(t, c2) {
+		t.Error("want the connection over the total limit closed")
+	}
+	if rejected(l, "total") != 1 {
+		t.Errorf("want one total rejection got %v", rejected(l, "total"))
+	}
+}
+
+func TestPerIPLimitBehindProxyProtocol(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback := func(ip net.IP) bool { return ip.IsLoopback() }
+	l, accepted := serveListener(NewListener(proxyprotocol.NewListener(inner, false, loopback), 0, 1, loopback))
+	defer l.Close()
+
+	// The server reads from each connection so that the header is read.
+	go func() {
+		for c := range accepted {
+			go io.Copy(c, c)
+		}
+	}()
+	proxied := func(client string) net.Conn {
+		c := dial(t, l)
+		if _, err := io.WriteString(c, "PROXY TCP4 "+client+" 192.0.2.1 1234 443\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c1 := proxied("198.51.100.7")
+	defer c1.Close()
+	c2 := proxied("198.51.100.8")
+	defer c2.Close()
+	if closedByServer(t, c1) || closedByServer(t, c2) {
+		t.Error("want connections from different clients through one proxy accepted")
+	}
+
+	c3 := proxied("198.51.100.7")
+	defer c3.Close()
+	if !closedByServer(t, c3) {
+		t.Error("want the second connection from a client behind the proxy closed")
+	}
+	if rejected(l, "per_ip") != 1 {
+		t.Errorf("want one per_ip rejection got %v", rejected(l, "per_ip"))
+	}
+}
+
+func TestRejectDoesNotWaitForProxyHeader(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback := func(ip net.IP) bool { return ip.IsLoopback() }
+	l, accepted := serveListener(NewListener(proxyprotocol.NewListener(inner, false, loopback), 1, 0, loopback))
+	defer l.Close()
+
+	c1 := dial(t, l)
+	defer c1.Close()
+	server1 := <-accepted
+	defer server1.Close()
+
+	// The load balancer opens a connection without sending a header yet,
+	// which must be rejected without waiting for one.
+	c2 := dial(t, l)
+	defer c2.Close()
+	if !closedByServer(t, c2) {
+		t.Error("want the connection over the total limit closed promptly")
+	}
+}
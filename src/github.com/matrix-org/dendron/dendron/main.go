@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
+	"database/sql"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/http/pprof"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
@@ -21,8 +23,24 @@ import (
 	stdlog "log"
 
 	log "github.com/Sirupsen/logrus"
-
+	_ "github.com/lib/pq"
+
+	"github.com/matrix-org/dendron/auth"
+	"github.com/matrix-org/dendron/bodylimit"
+	"github.com/matrix-org/dendron/certs"
+	"github.com/matrix-org/dendron/clientip"
+	"github.com/matrix-org/dendron/connlimit"
+	"github.com/matrix-org/dendron/handoff"
+	"github.com/matrix-org/dendron/login"
+	"github.com/matrix-org/dendron/loginguard"
+	"github.com/matrix-org/dendron/media"
 	"github.com/matrix-org/dendron/proxy"
+	"github.com/matrix-org/dendron/proxyprotocol"
+	"github.com/matrix-org/dendron/quota"
+	"github.com/matrix-org/dendron/ratelimit"
+	"github.com/matrix-org/dendron/systemd"
+	"github.com/matrix-org/dendron/tlspolicy"
+	"github.com/matrix-org/dendron/upstream"
 	"github.com/matrix-org/dendron/versions"
 
 	"github.com/matrix-org/dugong"
@@ -34,28 +52,97 @@ var (
 	startSynapse           = flag.Bool("start-synapse", true, "Start a synapse process, otherwise connect to an existing synapse")
 	synapseConfig          = flag.String("synapse-config", "homeserver.yaml", "Path to synapse's config")
 	synapsePython          = flag.String("synapse-python", "python", "A python interpreter to use for synapse. This should be the python binary installed inside synapse's virtualenv. The interpreter will be looked up on the $PATH")
-	synapseURLStr          = flag.String("synapse-url", "http://localhost:18448", "The HTTP URL that synapse is configured to listen on.")
-	listenAddr             = flag.String("addr", ":8448", "Address to listen for matrix requests on")
+	synapseURLStr          = flag.String("synapse-url", "http://localhost:18448", "The HTTP URL, or unix:/path/to/socket, that synapse is configured to listen on.")
+	listenAddr             = flag.String("addr", ":8448", "Address to listen for matrix requests on, or unix:/path/to/socket to listen on a unix socket")
 	listenTLS              = flag.Bool("tls", true, "Listen for HTTPS requests, otherwise listen for HTTP requests")
-	listenCertFile         = flag.String("cert-file", "", "TLS Certificate. This must match the tls_certificate_path configured for synapse.")
-	listenKeyFile          = flag.String("key-file", "", "TLS Private Key. The private key for the certificate. This must be set if listening for HTTPS requests")
+	listenCertFile         = flag.String("cert-file", "", "TLS Certificate. This must match the tls_certificate_path configured for synapse. A comma separated list of certificates can be given to choose between by SNI, the first is used if none match. Certificates are reloaded when they change on disk.")
+	listenKeyFile          = flag.String("key-file", "", "TLS Private Key. The private key for the certificate, or a comma separated list of keys in the same order as the certificates. This must be set if listening for HTTPS requests")
 	pusherConfig           = flag.String("pusher-config", "", "Pusher worker config")
 	appserviceConfig       = flag.String("appservice-config", "", "Appservice worker config")
 	synchrotronConfig      = flag.String("synchrotron-config", "", "Synchrotron worker config")
-	synchrotronURLStr      = flag.String("synchrotron-url", "", "Comma separated list of HTTP URLs that the synchrotron will listen on")
+	synchrotronURLStr      = flag.String("synchrotron-url", "", "Comma separated list of HTTP URLs, or unix:/path/to/socket URLs, that the synchrotron will listen on")
 	federationReaderConfig = flag.String("federation-reader-config", "", "Federation reader worker config")
-	federationReaderURLStr = flag.String("federation-reader-url", "", "The HTTP URL that the federation reader will listen on")
-	mediaRepositoryConfig  = flag.String("media-repository-config", "", "Media repository worker config")
-	mediaRepositoryURLStr  = flag.String("media-repository-url", "", "The HTTP URL that the media repository will listen on")
+	federationReaderURLStr = flag.String("federation-reader-url", "", "The HTTP URL, or unix:/path/to/socket, that the federation reader will listen on")
+	mediaRepositoryConfig  = flag.String("media-repository-config", "", "Comma separated list of media repository worker configs, one for each of -media-repository-url")
+	mediaRepositoryURLStr  = flag.String("media-repository-url", "", "Comma separated list of HTTP URLs, or unix:/path/to/socket URLs, that the media repositories will listen on. Requests for a piece of media are sharded between them by its ID")
 	clientReaderConfig     = flag.String("client-reader-config", "", "Client reader worker config")
-	clientReaderURLStr     = flag.String("client-reader-url", "", "The HTTP URL that the client reader will listen on")
+	clientReaderURLStr     = flag.String("client-reader-url", "", "The HTTP URL, or unix:/path/to/socket, that the client reader will listen on")
 	federationSenderConfig = flag.String("federation-sender-config", "", "Federation sender worker config")
 	userDirectroyConfig    = flag.String("user-directory-config", "", "User directory worker config")
-	userDirectoryURLStr    = flag.String("user-directory-url", "", "The HTTP URL that the user directory will listen on")
+	userDirectoryURLStr    = flag.String("user-directory-url", "", "The HTTP URL, or unix:/path/to/socket, that the user directory will listen on")
 	frontendProxyConfig    = flag.String("frontend-proxy-config", "", "Frontend proxy worker config")
-	frontendProxyURLStr    = flag.String("frontend-proxy-url", "", "The HTTP URL that the frontend proxy will listen on")
+	frontendProxyURLStr    = flag.String("frontend-proxy-url", "", "The HTTP URL, or unix:/path/to/socket, that the frontend proxy will listen on")
 	eventCreatorConfig     = flag.String("event-creator-config", "", "Event creator worker config")
-	eventCreatorURLStr     = flag.String("event-creator-url", "", "The HTTP URL that the event creator will listen on")
+	eventCreatorURLStr     = flag.String("event-creator-url", "", "The HTTP URL, or unix:/path/to/socket, that the event creator will listen on")
+
+	maxConnections       = flag.Int("max-connections", 0, "The most client connections to hold open at once. 0 means no limit")
+	maxConnectionsPerIP  = flag.Int("max-connections-per-ip", 0, "The most client connections to hold open at once from one IP address, not counting -trusted-proxies. With -proxy-protocol the address in the PROXY header is limited. 0 means no limit")
+	readHeaderTimeout    = flag.Duration("read-header-timeout", 30*time.Second, "How long a client has to send the headers of a request")
+	idleKeepAliveTimeout = flag.Duration("idle-timeout", 2*time.Minute, "How long to keep an idle keep-alive connection from a client open for")
+
+	maxClientBodySize = flag.Int64("max-client-body-size", 1<<20, "The largest request body in bytes to accept for the client-server API. 0 means no limit")
+	maxEventBodySize  = flag.Int64("max-event-body-size", 65536, "The largest request body in bytes to accept for sending an event. 0 means no limit")
+	maxUploadSize     = flag.Int64("max-upload-size", 50<<20, "The largest media upload in bytes to accept. 0 means no limit")
+
+	rateLimitsStr          = flag.String("rate-limits", "", "Comma separated list of rate limits in the form class=rate:burst, where rate is requests per second, e.g. createRoom=0.1:5,send=10:50. The classes are register, login, createRoom, join, invite, send and upload")
+	rateLimitExemptUsers   = flag.String("rate-limit-exempt-users", "", "Comma separated list of regular expressions for user IDs that aren't rate limited, e.g. appservice namespaces like @_irc_.*:example.org")
+	rateLimitExemptIPs     = flag.String("rate-limit-exempt-ips", "", "Comma separated list of CIDR ranges of client IPs that aren't rate limited")
+	accessTokenCacheSize   = flag.Int("access-token-cache-size", 10000, "How many access tokens to remember the users of")
+	validateAccessTokens   = flag.Bool("validate-access-tokens", false, "Check the access tokens of client and media API requests with synapse, and refuse unknown tokens without passing the request on")
+	accessTokenCacheExpiry = flag.Duration("access-token-cache-expiry", 5*time.Minute, "How long to remember the user an access token belongs to")
+	unknownTokenExpiry     = flag.Duration("unknown-access-token-cache-expiry", 10*time.Second, "How long to remember that synapse didn't recognise an access token. 0 means don't remember")
+	accessTokenTimeout     = flag.Duration("access-token-lookup-timeout", 10*time.Second, "How long to wait for synapse to say who an access token belongs to")
+
+	loginFailureThreshold = flag.Int("login-failure-threshold", 0, "How many failed logins in a row a username or client IP is allowed before it is locked out. 0 disables lockouts")
+	loginLockout          = flag.Duration("login-lockout", time.Minute, "How long the first lockout after failed logins lasts. Each further failure doubles it")
+	loginMaxLockout       = flag.Duration("login-max-lockout", time.Hour, "The longest a lockout after failed logins can last")
+	loginFailureWindow    = flag.Duration("login-failure-window", 24*time.Hour, "How long after its last failed login a username or client IP is forgotten")
+
+	synapsePostgres          = flag.String("synapse-postgres", "", "Connection string for synapse's postgres database, e.g. postgres://synapse@localhost/synapse, for the features that read it directly")
+	serverName               = flag.String("server-name", "", "The server_name synapse is configured with")
+	nativeLogin              = flag.Bool("native-login", false, "Handle m.login.password logins on existing devices against -synapse-postgres rather than passing them to synapse. Don't use this if synapse has password providers")
+	passwordPepper           = flag.String("password-pepper", "", "The password_config.pepper synapse is configured with")
+	mediaStorePath           = flag.String("media-store-path", "", "The media_store_path synapse is configured with")
+	nativeMediaDownloads     = flag.Bool("native-media-downloads", false, "Serve downloads of local media from -media-store-path, looking them up in -synapse-postgres, rather than passing them to the media repository")
+	mediaCSP                 = flag.String("media-csp", media.DefaultContentSecurityPolicy, "The Content-Security-Policy to set on media responses. Empty to leave it as the media repository set it")
+	mediaInlineTypesStr      = flag.String("media-inline-types", strings.Join(media.DefaultInlineTypes, ","), "Comma separated list of the media types that may be shown inline. Downloads of other types are served as attachments")
+	nativeMediaThumbnails    = flag.Bool("native-media-thumbnails", false, "Make thumbnails of local JPEG, PNG and GIF media from -media-store-path rather than asking the media repository")
+	thumbnailCachePath       = flag.String("thumbnail-cache-path", "", "Directory to keep the thumbnails made by -native-media-thumbnails in")
+	thumbnailCacheSize       = flag.Int64("thumbnail-cache-size", 1<<30, "The most bytes of thumbnails to keep in -thumbnail-cache-path")
+	maxThumbnailSourcePixels = flag.Int("max-thumbnail-source-pixels", 32000000, "The largest image in pixels to make thumbnails of natively. Larger images are passed to the media repository")
+	thumbnailSizes           = flag.String("thumbnail-sizes", media.DefaultThumbnailSizes, "Comma separated list of the sizes to make thumbnails in natively, in the form {width}x{height}-{crop|scale}. Requests are served with the closest larger size, like synapse's thumbnail_sizes")
+	maxConcurrentThumbnails  = flag.Int("max-concurrent-thumbnails", runtime.NumCPU(), "The most thumbnails to make natively at once. 0 means no limit")
+
+	uploadQuotaDaily = flag.Int64("upload-quota-daily", 0, "The most bytes of media each user may upload per UTC day. 0 means no limit")
+	uploadQuotaTotal = flag.Int64("upload-quota-total", 0, "The most bytes of media each user may upload in total. 0 means no limit")
+	uploadQuotaFile  = flag.String("upload-quota-file", "", "File to keep users' upload usage in, needed for -upload-quota-daily and -upload-quota-total")
+
+	adminToken = flag.String("admin-token", "", "The bearer token that must be given to use dendron's admin API under /_dendron/admin/. The admin API is disabled if it is empty")
+
+	backendMaxIdleConns = flag.Int("backend-max-idle-conns", upstream.DefaultOptions.MaxIdleConns, "How many idle connections to keep open to each backend")
+	backendMaxConns     = flag.Int("backend-max-conns", upstream.DefaultOptions.MaxConns, "The most connections to open to each backend, after which requests wait for a connection. 0 means no limit")
+	backendIdleTimeout  = flag.Duration("backend-idle-timeout", upstream.DefaultOptions.IdleTimeout, "How long to keep idle connections to backends open for")
+	backendKeepAlive    = flag.Duration("backend-keepalive", upstream.DefaultOptions.KeepAlive, "The interval between TCP keep-alive probes on connections to backends")
+	backendDialTimeout  = flag.Duration("backend-dial-timeout", upstream.DefaultOptions.DialTimeout, "How long to wait when connecting to a backend")
+
+	endpointSpecDir   = flag.String("endpoint-specs", "", "Directory of swagger API specs, or a matrix-doc checkout, to read the endpoints to label metrics with. Defaults to the endpoints built in from the vendored matrix-doc")
+	extraEndpointsStr = flag.String("extra-endpoints", "", "Comma separated list of extra path templates to label metrics with, e.g. /_matrix/client/r0/custom/{param}")
+
+	tlsMinVersion            = flag.String("tls-min-version", "", "The lowest TLS version to accept: 1.0, 1.1, 1.2 or 1.3. Defaults to Go's default")
+	tlsCipherSuitesStr       = flag.String("tls-cipher-suites", "", "Comma separated list of the cipher suites to allow for TLS 1.2 and below, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Defaults to Go's default")
+	tlsCurvesStr             = flag.String("tls-curves", "", "Comma separated list of the key exchanges to allow in order of preference, from X25519, X25519MLKEM768, P256, P384 and P521. Defaults to Go's default")
+	tlsSessionTickets        = flag.Bool("tls-session-tickets", true, "Allow TLS sessions to be resumed with session tickets")
+	tlsTicketRotation        = flag.Duration("tls-session-ticket-rotation", 0, "How often to replace the session ticket key. Defaults to Go's automatic daily rotation")
+	tlsClientAuth            = flag.String("tls-client-auth", "", "Ask clients for a TLS certificate signed by -tls-client-ca: \"request\" to verify it if one is given, or \"require\" to refuse connections without one")
+	tlsClientCAFile          = flag.String("tls-client-ca", "", "PEM bundle of the CAs that client certificates must be signed by")
+	tlsClientCertPrefixesStr = flag.String("tls-client-cert-prefixes", "", "Comma separated list of path prefixes, e.g. /_synapse/admin/, that are refused unless the client gave a verified certificate. Needs -tls-client-auth")
+
+	trustedProxiesStr   = flag.String("trusted-proxies", "", "Comma separated list of CIDR ranges of load balancers or proxies in front of dendron whose X-Forwarded-For and PROXY protocol headers are trusted")
+	proxyProtocol       = flag.String("proxy-protocol", "", "Accept PROXY protocol headers from trusted proxies, either \"before-tls\" if the header is sent before the TLS handshake or \"after-tls\" if it is sent inside the TLS connection")
+	proxyProtocolStrict = flag.Bool("proxy-protocol-strict", false, "Reject connections that don't start with a PROXY protocol header")
+
+	handoffTimeout      = flag.Duration("handoff-timeout", time.Minute, "How long to wait for a new dendron started by SIGUSR2 to take over before giving up on it")
+	handoffDrainTimeout = flag.Duration("handoff-drain-timeout", time.Minute, "How long to wait for in-flight requests to finish after handing over to a new dendron")
 
 	logDir = flag.String("log-dir", "var", "Logging output directory, Dendron logs to error.log, warn.log and info.log in that directory")
 )
@@ -63,26 +150,44 @@ var (
 var (
 	// Unused flags kept for compatibility with previous versions.
 	_ = flag.String("macaroon-secret", "", "Unused")
-	_ = flag.String("synapse-postgres", "", "Unused")
-	_ = flag.String("server-name", "", "Unused")
 )
 
-func startProcess(app string, processURL *url.URL, terminate chan<- string, name string, args ...string) (*log.Entry, func(), error) {
-	process := exec.Command(name, args...)
-	process.Stderr = os.Stderr
+// notifier tells systemd about dendron's state when it runs as a notify service.
+var notifier *systemd.Notifier
+
+// inherited is what the dendron that handed over to this one passed on, if any.
+var inherited *handoff.Inheritance
+
+// supervised is every process that has been started or adopted, so that they
+// can be handed over to a new dendron.
+var supervised []*handoff.Process
+
+func startProcess(app string, processURL *upstream.Upstream, terminate chan<- string, name string, args ...string) (*log.Entry, func(), error) {
 	processLog := log.WithField("app", app)
 
 	if processURL != nil {
 		processLog = processLog.WithField("processURL", processURL.String())
 	}
 
-	processLog.Print("Starting process")
+	process := inherited.Process(app)
+	if process != nil {
+		processLog = processLog.WithField("pid", process.Pid)
+		processLog.Print("Adopting process")
+	} else {
+		cmd := exec.Command(name, args...)
+		cmd.Stderr = os.Stderr
+
+		processLog.Print("Starting process")
 
-	if err := process.Start(); err != nil {
-		return processLog, nil, err
+		var err error
+		if process, err = handoff.Start(app, cmd); err != nil {
+			return processLog, nil, err
+		}
 	}
+	supervised = append(supervised, process)
 
 	if processURL != nil {
+		notifier.Status(fmt.Sprintf("Waiting for %s", app))
 		if err := waitForProcess(processURL, processLog); err != nil {
 			return processLog, nil, err
 		}
@@ -90,38 +195,47 @@ func startProcess(app string, processURL *url.URL, terminate chan<- string, name
 
 	go func() {
 		// Wait for process to stop.
-		if _, err := process.Process.Wait(); err != nil {
-			processLog.WithError(err).Print("Error waiting for process")
-		}
+		<-process.Exited()
 		terminate <- fmt.Sprintf("Process %s Stopped", app)
 	}()
 
 	cleanup := func() {
-		processLog.Print("Stopping process")
+		stopProcess(process, processLog)
+	}
 
-		go func() {
-			// Give the process ten seconds to shutdown cleanly.
-			time.Sleep(10 * time.Second)
-			processLog.Print("Process failed to stop within 10 seconds")
-			process.Process.Signal(syscall.SIGKILL)
-		}()
+	return processLog, cleanup, nil
+}
 
-		if err := process.Process.Signal(syscall.SIGTERM); err != nil {
-			processLog.WithError(err).Print("Failed to kill process")
-		}
-		process.Process.Wait()
+func stopProcess(process *handoff.Process, processLog *log.Entry) {
+	if !process.Owned() {
+		processLog.Print("Leaving process running for the new dendron")
+		return
 	}
 
-	return processLog, cleanup, nil
+	processLog.Print("Stopping process")
+
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		processLog.WithError(err).Print("Failed to kill process")
+	}
+
+	// Give the process ten seconds to shutdown cleanly.
+	select {
+	case <-process.Exited():
+	case <-time.After(10 * time.Second):
+		processLog.Print("Process failed to stop within 10 seconds")
+		process.Signal(syscall.SIGKILL)
+		<-process.Exited()
+	}
 }
 
-func waitForProcess(processURL *url.URL, processLog *log.Entry) error {
+func waitForProcess(processURL *upstream.Upstream, processLog *log.Entry) error {
 	processLog.Print("Connecting to process")
+	client := processURL.Client()
 	period := 50 * time.Millisecond
 	timeout := 20 * time.Second
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
-		if resp, err := http.Get(processURL.String()); err == nil {
+		if resp, err := client.Get(processURL.URL.String()); err == nil {
 			resp.Body.Close()
 			return nil
 		}
@@ -140,9 +254,66 @@ func setMaxOpenFiles() (uint64, error) {
 	return limit.Max, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
 }
 
+// requireAdminToken wraps next so that requests without the -admin-token are
+// refused.
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := auth.AccessToken(req)
+		if *adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        fmt.Errorf("admin API request for %s without the admin token", req.URL.Path),
+				StatusCode: 403,
+				ErrCode:    "M_FORBIDDEN",
+				Message:    "Forbidden",
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// splitList splits a comma separated flag value, returning nil if it is empty.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// listen listens on addr, which is either a TCP address or the path of a unix
+// socket prefixed with "unix:". A socket file left behind by a previous
+// process is removed first.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	socketPath := strings.TrimPrefix(addr, "unix:")
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("socket %s is already in use", socketPath)
+	}
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", socketPath)
+}
+
 func main() {
 	flag.Parse()
 
+	// Both of these remove their environment variables so they have to run
+	// before any processes are started.
+	notifier = systemd.NewNotifier()
+	activatedListeners, err := systemd.Listeners()
+	if err != nil {
+		panic(err)
+	}
+	if inherited, err = handoff.Inherited(); err != nil {
+		panic(err)
+	}
+
 	log.AddHook(dugong.NewFSHook(
 		filepath.Join(*logDir, "info.log"),
 		filepath.Join(*logDir, "warn.log"),
@@ -155,88 +326,110 @@ func main() {
 		log.WithField("files", noFiles).Printf("Set maximum number of open files")
 	}
 
-	proxyMetrics := prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "synapse_proxy_request_durations_microseconds",
-			Help: "Histogram of microsecond durations of requests to underlying synapse for proxied requests",
-
-			// Manually curated list of expected request timings.
-			// Ranges from <1ms to <2 minutes, and then an auto-generated >2 minutes bucket.
-			Buckets: []float64{
-				// <1s
-				1000, 10000, 25000, 50000, 75000, 100000,
-				// <10s
-				1000000, 1250000, 1500000, 1750000, 2000000, 3000000, 4000000, 5000000,
-				// <60s
-				10000000, 20000000, 30000000, 45000000,
-				// >= 60s
-				60000000, 120000000,
-			},
-		},
-		[]string{"path", "method"},
-	)
+	proxyMetrics := proxy.NewMetrics()
 	prometheus.MustRegister(proxyMetrics)
 
-	synapseURL, err := url.Parse(*synapseURLStr)
+	upstreamMetrics := upstream.NewMetrics()
+	prometheus.MustRegister(upstreamMetrics)
+
+	if *endpointSpecDir != "" {
+		if err := proxy.LoadEndpointSpecs(*endpointSpecDir); err != nil {
+			panic(err)
+		}
+	}
+
+	if *extraEndpointsStr != "" {
+		if err := proxy.AddEndpoints(strings.Split(*extraEndpointsStr, ",")); err != nil {
+			panic(err)
+		}
+	}
+
+	switch *proxyProtocol {
+	case "", "before-tls", "after-tls":
+	default:
+		panic(fmt.Errorf("invalid -proxy-protocol %q", *proxyProtocol))
+	}
+
+	clientIPResolver, err := clientip.NewResolver(strings.Split(*trustedProxiesStr, ","))
+	if err != nil {
+		panic(err)
+	}
+	prometheus.MustRegister(clientIPResolver)
+
+	// These can be overridden for each backend by parameters in its URL.
+	backendOptions := upstream.Options{
+		MaxIdleConns: *backendMaxIdleConns,
+		MaxConns:     *backendMaxConns,
+		IdleTimeout:  *backendIdleTimeout,
+		KeepAlive:    *backendKeepAlive,
+		DialTimeout:  *backendDialTimeout,
+	}
+
+	synapseURL, err := upstream.Parse(*synapseURLStr, backendOptions)
 	if err != nil {
 		panic(err)
 	}
 
 	var synchrotronURLs []string
-	var synchrotronURL *url.URL
+	var synchrotronURL *upstream.Upstream
 	if *synchrotronURLStr != "" {
 		synchrotronURLs = strings.Split(*synchrotronURLStr, ",")
 		for _, urlStr := range synchrotronURLs {
-			synchrotronURL, err = url.Parse(urlStr)
+			synchrotronURL, err = upstream.Parse(urlStr, backendOptions)
 			if err != nil {
 				panic(err)
 			}
 		}
 	}
 
-	var federationReaderURL *url.URL
+	var federationReaderURL *upstream.Upstream
 	if *federationReaderURLStr != "" {
-		federationReaderURL, err = url.Parse(*federationReaderURLStr)
+		federationReaderURL, err = upstream.Parse(*federationReaderURLStr, backendOptions)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	var mediaRepositoryURL *url.URL
+	var mediaRepositoryURLs []string
+	var mediaRepositories []*upstream.Upstream
 	if *mediaRepositoryURLStr != "" {
-		mediaRepositoryURL, err = url.Parse(*mediaRepositoryURLStr)
-		if err != nil {
-			panic(err)
+		mediaRepositoryURLs = strings.Split(*mediaRepositoryURLStr, ",")
+		for _, urlStr := range mediaRepositoryURLs {
+			mediaRepositoryURL, err := upstream.Parse(urlStr, backendOptions)
+			if err != nil {
+				panic(err)
+			}
+			mediaRepositories = append(mediaRepositories, mediaRepositoryURL)
 		}
 	}
 
-	var clientReaderURL *url.URL
+	var clientReaderURL *upstream.Upstream
 	if *clientReaderURLStr != "" {
-		clientReaderURL, err = url.Parse(*clientReaderURLStr)
+		clientReaderURL, err = upstream.Parse(*clientReaderURLStr, backendOptions)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	var userDirectoryURL *url.URL
+	var userDirectoryURL *upstream.Upstream
 	if *userDirectoryURLStr != "" {
-		userDirectoryURL, err = url.Parse(*userDirectoryURLStr)
+		userDirectoryURL, err = upstream.Parse(*userDirectoryURLStr, backendOptions)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	var frontendProxyURL *url.URL
+	var frontendProxyURL *upstream.Upstream
 	if *frontendProxyURLStr != "" {
-		frontendProxyURL, err = url.Parse(*frontendProxyURLStr)
+		frontendProxyURL, err = upstream.Parse(*frontendProxyURLStr, backendOptions)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	var eventCreatorURL *url.URL
+	var eventCreatorURL *upstream.Upstream
 	if *eventCreatorURLStr != "" {
-		eventCreatorURL, err = url.Parse(*eventCreatorURLStr)
+		eventCreatorURL, err = upstream.Parse(*eventCreatorURLStr, backendOptions)
 		if err != nil {
 			panic(err)
 		}
@@ -337,19 +530,29 @@ func main() {
 		}
 
 		if *mediaRepositoryConfig != "" {
-			processLog, cleanup, err := startProcess(
-				"mediaRepository", mediaRepositoryURL, terminate,
-				*synapsePython,
-				"-m", "synapse.app.media_repository",
-				"-c", *synapseConfig,
-				"-c", *mediaRepositoryConfig,
-			)
-
-			if err != nil {
-				processLog.Panic(err)
+			configs := strings.Split(*mediaRepositoryConfig, ",")
+			if len(configs) != len(mediaRepositories) {
+				panic("-media-repository-config needs a config for each -media-repository-url")
 			}
+			for i, config := range configs {
+				app := "mediaRepository"
+				if i > 0 {
+					app = fmt.Sprintf("mediaRepository%d", i)
+				}
+				processLog, cleanup, err := startProcess(
+					app, mediaRepositories[i], terminate,
+					*synapsePython,
+					"-m", "synapse.app.media_repository",
+					"-c", *synapseConfig,
+					"-c", config,
+				)
 
-			defer cleanup()
+				if err != nil {
+					processLog.Panic(err)
+				}
+
+				defer cleanup()
+			}
 		}
 
 		if *clientReaderConfig != "" {
@@ -437,13 +640,25 @@ func main() {
 		synapseLog.Print("Using existing synapse")
 	}
 
-	reverseProxy := proxy.MeasureByPath(proxyMetrics, httputil.NewSingleHostReverseProxy(synapseURL).ServeHTTP)
+	upstreamMetrics.Add("synapse", synapseURL)
+	reverseProxy := proxy.MeasureByPath(
+		proxyMetrics, proxy.Backend{Pool: "synapse", Instance: synapseURL.Name},
+		synapseURL.ReverseProxy().ServeHTTP,
+	)
 
-	versionsHandler, err := versions.NewHandler(synapseURL, time.Hour)
+	versionsHandler, err := versions.NewHandler(synapseURL.URL, synapseURL.Client(), time.Hour)
 	if err != nil {
 		panic(err)
 	}
 
+	tokenResolver, err := auth.NewResolver(synapseURL.URL, synapseURL.Client(), *accessTokenCacheSize, *accessTokenCacheExpiry)
+	if err != nil {
+		panic(err)
+	}
+	tokenResolver.UnknownTokenTTL = *unknownTokenExpiry
+	tokenResolver.Timeout = *accessTokenTimeout
+	prometheus.MustRegister(tokenResolver)
+
 	proxyFunc := prometheus.InstrumentHandler("proxy", reverseProxy)
 	versionsFunc := prometheus.InstrumentHandler("versions", versionsHandler)
 
@@ -455,13 +670,14 @@ func main() {
 		ring := hashring.New(synchrotronURLs)
 		proxies := make(map[string]http.HandlerFunc)
 		for _, urlStr := range synchrotronURLs {
-			synchrotronURL, err := url.Parse(urlStr)
+			synchrotronURL, err := upstream.Parse(urlStr, backendOptions)
 			if err != nil {
 				panic(err)
 			}
+			upstreamMetrics.Add("synchrotron", synchrotronURL)
 			synchrotronReverseProxy := proxy.MeasureByPath(
-				proxyMetrics,
-				httputil.NewSingleHostReverseProxy(synchrotronURL).ServeHTTP,
+				proxyMetrics, proxy.Backend{Pool: "synchrotron", Instance: synchrotronURL.Name},
+				synchrotronURL.ReverseProxy().ServeHTTP,
 			)
 			synchrotronFunc := prometheus.InstrumentHandler(
 				"synchrotron", synchrotronReverseProxy,
@@ -470,17 +686,7 @@ func main() {
 		}
 
 		balancerFunc := func(w http.ResponseWriter, req *http.Request) {
-			key := req.URL.Query().Get("access_token")
-			if key == "" {
-				// If there isn't an access_token query string then check for a Authorization header with a Bearer token.
-				auth := req.Header.Get("Authorization")
-				const (
-					BEARER = "Bearer "
-				)
-				if strings.HasPrefix(auth, BEARER) {
-					key = auth[len(BEARER):]
-				}
-			}
+			key := auth.AccessToken(req)
 			if key == "" {
 				// If there isn't an access token then pick a backend at random.
 				var randomBytes [8]byte
@@ -526,9 +732,10 @@ func main() {
 	}
 
 	if federationReaderURL != nil {
+		upstreamMetrics.Add("federationReader", federationReaderURL)
 		federationReaderReverseProxy := proxy.MeasureByPath(
-			proxyMetrics,
-			httputil.NewSingleHostReverseProxy(federationReaderURL).ServeHTTP,
+			proxyMetrics, proxy.Backend{Pool: "federationReader", Instance: federationReaderURL.Name},
+			federationReaderURL.ReverseProxy().ServeHTTP,
 		)
 		federationReaderFunc := prometheus.InstrumentHandler(
 			"federationReader", federationReaderReverseProxy,
@@ -541,21 +748,48 @@ func main() {
 		mux.Handle("/_matrix/federation/v1/publicRooms", federationReaderFunc)
 	}
 
-	if mediaRepositoryURL != nil {
-		mediaRepostioryReverseProxy := proxy.MeasureByPath(
-			proxyMetrics,
-			httputil.NewSingleHostReverseProxy(mediaRepositoryURL).ServeHTTP,
-		)
-		mediaRepositoryFunc := prometheus.InstrumentHandler(
-			"mediaRepository", mediaRepostioryReverseProxy,
-		)
+	// mediaFunc handles the media requests that dendron doesn't serve itself.
+	var mediaFunc http.Handler = proxyFunc
+	if mediaRepositories != nil {
+		ring := hashring.New(mediaRepositoryURLs)
+		proxies := make(map[string]http.HandlerFunc)
+		for i, mediaRepositoryURL := range mediaRepositories {
+			upstreamMetrics.Add("mediaRepository", mediaRepositoryURL)
+			mediaRepostioryReverseProxy := proxy.MeasureByPath(
+				proxyMetrics, proxy.Backend{Pool: "mediaRepository", Instance: mediaRepositoryURL.Name},
+				mediaRepositoryURL.ReverseProxy().ServeHTTP,
+			)
+			proxies[mediaRepositoryURLs[i]] = prometheus.InstrumentHandler(
+				"mediaRepository", mediaRepostioryReverseProxy,
+			)
+		}
+
+		mediaRepositoryFunc := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			key := media.ShardKey(req.URL.Path)
+			if key == "" {
+				// Uploads and the like can go to any media repository.
+				var randomBytes [8]byte
+				_, _ = rand.Read(randomBytes[:])
+				key = string(randomBytes[:])
+			}
+			node, ok := ring.GetNode(key)
+			if !ok {
+				req.Body.Close()
+				w.WriteHeader(503)
+				w.Write([]byte("No backend media repository available"))
+				return
+			}
+			proxies[node](w, req)
+		})
 		mux.Handle("/_matrix/media/", mediaRepositoryFunc)
+		mediaFunc = mediaRepositoryFunc
 	}
 
 	if clientReaderURL != nil {
+		upstreamMetrics.Add("clientReader", clientReaderURL)
 		clientReaderReverseProxy := proxy.MeasureByPath(
-			proxyMetrics,
-			httputil.NewSingleHostReverseProxy(clientReaderURL).ServeHTTP,
+			proxyMetrics, proxy.Backend{Pool: "clientReader", Instance: clientReaderURL.Name},
+			clientReaderURL.ReverseProxy().ServeHTTP,
 		)
 		clientReaderFunc := prometheus.InstrumentHandler(
 			"clientReader", clientReaderReverseProxy,
@@ -564,10 +798,68 @@ func main() {
 		mux.Handle("/_matrix/client/api/v1/publicRooms", clientReaderFunc)
 	}
 
+	var synapseDB *sql.DB
+	if *synapsePostgres != "" {
+		if synapseDB, err = sql.Open("postgres", *synapsePostgres); err != nil {
+			panic(err)
+		}
+		defer synapseDB.Close()
+	}
+
+	if *nativeLogin {
+		if synapseDB == nil || *serverName == "" {
+			panic("-native-login needs -synapse-postgres and -server-name")
+		}
+		loginHandler := login.NewHandler(synapseDB, *serverName, *passwordPepper, proxyFunc)
+		prometheus.MustRegister(loginHandler)
+		loginFunc := prometheus.InstrumentHandler("login", loginHandler)
+		mux.Handle("/_matrix/client/r0/login", loginFunc)
+		mux.Handle("/_matrix/client/api/v1/login", loginFunc)
+	}
+
+	if *nativeMediaDownloads || *nativeMediaThumbnails {
+		if synapseDB == nil || *serverName == "" || *mediaStorePath == "" {
+			panic("-native-media-downloads and -native-media-thumbnails need -synapse-postgres, -server-name and -media-store-path")
+		}
+	}
+	mediaStore := media.NewStore(synapseDB, *mediaStorePath, *serverName)
+	if *nativeMediaDownloads {
+		downloadHandler := media.NewDownloadHandler(mediaStore, mediaFunc)
+		prometheus.MustRegister(downloadHandler)
+		downloadFunc := prometheus.InstrumentHandler("mediaDownload", downloadHandler)
+		for _, version := range []string{"r0", "v1", "v3"} {
+			mux.Handle("/_matrix/media/"+version+"/download/", downloadFunc)
+		}
+	}
+	if *nativeMediaThumbnails {
+		if *thumbnailCachePath == "" {
+			panic("-native-media-thumbnails needs -thumbnail-cache-path")
+		}
+		thumbnailCache, err := media.NewThumbnailCache(*thumbnailCachePath, *thumbnailCacheSize)
+		if err != nil {
+			panic(err)
+		}
+		sizes, err := media.ParseThumbnailSizes(*thumbnailSizes)
+		if err != nil {
+			panic(err)
+		}
+		thumbnailHandler := media.NewThumbnailHandler(mediaStore, thumbnailCache, media.ThumbnailOptions{
+			Sizes:         sizes,
+			MaxPixels:     *maxThumbnailSourcePixels,
+			MaxConcurrent: *maxConcurrentThumbnails,
+		}, mediaFunc)
+		prometheus.MustRegister(thumbnailHandler)
+		thumbnailFunc := prometheus.InstrumentHandler("mediaThumbnail", thumbnailHandler)
+		for _, version := range []string{"r0", "v1", "v3"} {
+			mux.Handle("/_matrix/media/"+version+"/thumbnail/", thumbnailFunc)
+		}
+	}
+
 	mux.HandleFunc("/_dendron/test", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintln(w, "test")
 	})
 	mux.Handle("/_dendron/metrics", prometheus.Handler())
+	mux.Handle("/_dendron/admin/", requireAdminToken(http.NotFoundHandler()))
 
 	// The debug pprof handlers have to be hosted under "/debug/pprof" because
 	// that string is hardcoded inside them.
@@ -576,38 +868,239 @@ func main() {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	var handler http.Handler = mux
+	if *loginFailureThreshold > 0 {
+		guard, err := loginguard.NewGuard(loginguard.Options{
+			Threshold:  *loginFailureThreshold,
+			Lockout:    *loginLockout,
+			MaxLockout: *loginMaxLockout,
+			Window:     *loginFailureWindow,
+		})
+		if err != nil {
+			panic(err)
+		}
+		prometheus.MustRegister(guard)
+		handler = guard.Handler(handler)
+		const prefix = "/_dendron/admin/login_lockouts"
+		mux.Handle(prefix, requireAdminToken(guard.AdminHandler(prefix)))
+		mux.Handle(prefix+"/", requireAdminToken(guard.AdminHandler(prefix)))
+	}
+	if *rateLimitsStr != "" {
+		limits, err := ratelimit.ParseLimits(*rateLimitsStr)
+		if err != nil {
+			panic(err)
+		}
+		limiter, err := ratelimit.NewLimiter(
+			limits, tokenResolver.UserID,
+			splitList(*rateLimitExemptUsers), splitList(*rateLimitExemptIPs),
+		)
+		if err != nil {
+			panic(err)
+		}
+		prometheus.MustRegister(limiter)
+		handler = limiter.Handler(handler)
+	}
+	if *uploadQuotaDaily > 0 || *uploadQuotaTotal > 0 {
+		if *uploadQuotaFile == "" {
+			panic("-upload-quota-daily and -upload-quota-total need -upload-quota-file")
+		}
+		// The dendron that handed over may still be appending to the file.
+		quotaStore, err := quota.OpenStore(*uploadQuotaFile, inherited == nil)
+		if err != nil {
+			panic(err)
+		}
+		defer quotaStore.Close()
+		quotaLimiter := quota.NewLimiter(
+			quota.Quotas{Daily: *uploadQuotaDaily, Total: *uploadQuotaTotal, MaxUpload: *maxUploadSize},
+			quotaStore, tokenResolver.UserID,
+		)
+		prometheus.MustRegister(quotaLimiter)
+		handler = quotaLimiter.Handler(handler)
+		const prefix = "/_dendron/admin/upload_quotas"
+		mux.Handle(prefix, requireAdminToken(quotaLimiter.AdminHandler(prefix)))
+		mux.Handle(prefix+"/", requireAdminToken(quotaLimiter.AdminHandler(prefix)))
+	}
+	handler = media.NewPolicy(*mediaCSP, splitList(*mediaInlineTypesStr)).Handler(handler)
+	handler = tokenResolver.Handler(*validateAccessTokens, handler)
+	bodyLimiter := bodylimit.NewLimiter(bodylimit.Limits{
+		Upload: *maxUploadSize,
+		Event:  *maxEventBodySize,
+		Client: *maxClientBodySize,
+	})
+	prometheus.MustRegister(bodyLimiter)
+	handler = bodyLimiter.Handler(handler)
+
 	logWriter := log.StandardLogger().Writer()
 	defer logWriter.Close()
 	s := &http.Server{
-		Addr:           *listenAddr,
-		Handler:        mux,
-		ReadTimeout:    30 * time.Minute,
-		WriteTimeout:   30 * time.Minute,
-		MaxHeaderBytes: 1 << 20,
-		ErrorLog:       stdlog.New(logWriter, "", 0),
+		Addr:              *listenAddr,
+		Handler:           clientIPResolver.Handler(handler),
+		ReadTimeout:       30 * time.Minute,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      30 * time.Minute,
+		IdleTimeout:       *idleKeepAliveTimeout,
+		MaxHeaderBytes:    1 << 20,
+		ErrorLog:          stdlog.New(logWriter, "", 0),
 	}
 
-	listener, err := net.Listen("tcp", s.Addr)
-	if err != nil {
-		panic(err)
+	var listener net.Listener
+	switch {
+	case inherited != nil:
+		listener = inherited.Listener
+		log.WithField("addr", listener.Addr().String()).Print("Using listener handed over by the previous dendron")
+	case len(activatedListeners) == 1:
+		listener = activatedListeners[0]
+		log.WithField("addr", listener.Addr().String()).Print("Using socket activated listener")
+	case len(activatedListeners) > 1:
+		panic(fmt.Errorf("expected one socket activated listener, got %d", len(activatedListeners)))
+	default:
+		if listener, err = listen(s.Addr); err != nil {
+			panic(err)
+		}
+	}
+
+	// The listener is handed over to a new dendron before it is wrapped.
+	handoffListener := listener
+
+	wrapProxyProtocol := func(inner net.Listener) net.Listener {
+		proxyListener := proxyprotocol.NewListener(inner, *proxyProtocolStrict, clientIPResolver.IsTrusted)
+		prometheus.MustRegister(proxyListener)
+		return proxyListener
+	}
+
+	// The connections are limited after any PROXY protocol listener so that
+	// the per IP limit applies to the address in the PROXY header rather than
+	// to the load balancer. Other connections from trusted proxies count
+	// against the total but not the per IP limit.
+	limitConnections := func(inner net.Listener) net.Listener {
+		limitListener := connlimit.NewListener(inner, *maxConnections, *maxConnectionsPerIP, clientIPResolver.IsTrusted)
+		prometheus.MustRegister(limitListener)
+		return limitListener
+	}
+
+	switch *proxyProtocol {
+	case "before-tls":
+		listener = limitConnections(wrapProxyProtocol(listener))
+	case "after-tls":
+		// The connections are limited once the PROXY protocol listener
+		// wraps the TLS listener below.
+	default:
+		listener = limitConnections(listener)
 	}
 
 	if *listenTLS {
-		cert, err := tls.LoadX509KeyPair(*listenCertFile, *listenKeyFile)
+		certFiles := strings.Split(*listenCertFile, ",")
+		keyFiles := strings.Split(*listenKeyFile, ",")
+		if len(certFiles) != len(keyFiles) {
+			panic(fmt.Errorf("got %d certificates but %d keys", len(certFiles), len(keyFiles)))
+		}
+		var pairs []certs.Pair
+		for i := range certFiles {
+			pairs = append(pairs, certs.Pair{CertFile: certFiles[i], KeyFile: keyFiles[i]})
+		}
+		certStore, err := certs.NewStore(pairs)
 		if err != nil {
 			panic(err)
 		}
+		if err := certStore.Watch(); err != nil {
+			panic(err)
+		}
+		defer certStore.Close()
+		prometheus.MustRegister(certStore)
 
 		s.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: certStore.GetCertificate,
 		}
+		err = tlspolicy.Apply(s.TLSConfig, tlspolicy.Options{
+			MinVersion:            *tlsMinVersion,
+			CipherSuites:          splitList(*tlsCipherSuitesStr),
+			Curves:                splitList(*tlsCurvesStr),
+			DisableSessionTickets: !*tlsSessionTickets,
+			ClientAuth:            *tlsClientAuth,
+			ClientCAFile:          *tlsClientCAFile,
+		})
+		if err != nil {
+			panic(err)
+		}
+		if *tlsSessionTickets && *tlsTicketRotation > 0 {
+			if err := tlspolicy.RotateTicketKeys(s.TLSConfig, *tlsTicketRotation, nil); err != nil {
+				panic(err)
+			}
+		}
+
+		tlsListener := tlspolicy.NewListener(listener, s.TLSConfig)
+		prometheus.MustRegister(tlsListener)
+		listener = tlsListener
+	}
 
-		listener = tls.NewListener(listener, s.TLSConfig)
+	if prefixes := splitList(*tlsClientCertPrefixesStr); prefixes != nil {
+		if *tlsClientAuth == "" || !*listenTLS || *proxyProtocol == "after-tls" {
+			// The requests don't have their TLS state with after-tls.
+			panic(fmt.Errorf("-tls-client-cert-prefixes needs -tls and -tls-client-auth, and can't be used with -proxy-protocol after-tls"))
+		}
+		s.Handler = tlspolicy.RequireClientCert(prefixes, s.Handler)
+	}
+
+	if *proxyProtocol == "after-tls" {
+		// The connections won't be *tls.Conns once they are wrapped so the
+		// requests won't have their TLS connection state set.
+		listener = limitConnections(wrapProxyProtocol(listener))
 	}
 
 	go s.Serve(listener)
 
+	if inherited != nil {
+		unclaimed, err := inherited.Ready()
+		if err != nil {
+			log.WithError(err).Print("Failed to tell the previous dendron that we are ready")
+		}
+		for _, process := range unclaimed {
+			go stopProcess(process, log.WithField("app", process.App))
+		}
+	}
+
+	notifier.Ready("Serving requests")
+	stopWatchdog := make(chan struct{})
+	go notifier.Watchdog(stopWatchdog)
+
+	// On SIGUSR2 start a new dendron from the binary on disk and hand the
+	// listener and processes over to it.
+	handedOver := make(chan struct{})
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	go func() {
+		for range upgrades {
+			log.Print("Handing over to a new dendron")
+			pid, err := handoff.Upgrade(
+				os.Args[0], os.Args[1:], notifier.Environ(),
+				handoffListener, supervised, *handoffTimeout,
+			)
+			if err != nil {
+				log.WithError(err).Error("Failed to hand over to a new dendron")
+				continue
+			}
+			notifier.MainPID(pid)
+			close(handedOver)
+			terminate <- fmt.Sprintf("Handed over to dendron %d", pid)
+			return
+		}
+	}()
+
 	reason := <-terminate
 
 	log.WithField("reason", reason).Print("Shutting Down")
+	close(stopWatchdog)
+
+	select {
+	case <-handedOver:
+		// The new dendron is accepting connections so stop accepting them
+		// and give the requests we are serving a chance to finish.
+		ctx, cancel := context.WithTimeout(context.Background(), *handoffDrainTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.WithError(err).Print("Failed to drain in-flight requests")
+		}
+	default:
+		notifier.Stopping()
+	}
 }
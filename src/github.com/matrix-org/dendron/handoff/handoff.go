@@ -0,0 +1,299 @@
+// Package handoff lets a running dendron hand its listening socket and the
+// synapse processes it supervises over to a new dendron binary, so that
+// dendron can be upgraded without dropping connections or restarting synapse.
+//
+// The old dendron starts the new one with the listener, one pipe per process
+// and a readiness pipe as inherited file descriptors, described by the
+// DENDRON_HANDOFF environment variable. Once the new dendron has adopted them
+// and is serving requests it writes to the readiness pipe, and the old one
+// drains its in-flight requests and exits without stopping the processes.
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// envVar holds the description of the inherited file descriptors.
+const envVar = "DENDRON_HANDOFF"
+
+// firstFD is the descriptor number of the first of exec.Cmd's ExtraFiles.
+const firstFD = 3
+
+// A Process is a synapse process supervised by dendron. It is either started
+// by this dendron or adopted from the dendron that handed over to it.
+//
+// Every process is given the write end of a pipe, its lifeline, when it is
+// started. The pipe reaches end of file when the process exits, which lets a
+// dendron that isn't the parent of a process know when it has stopped.
+type Process struct {
+	App string
+	Pid int
+
+	lifeline *os.File
+	exited   chan struct{}
+
+	mutex sync.Mutex
+	owned bool
+}
+
+// Start starts cmd as the process for app.
+func Start(app string, cmd *exec.Cmd) (*Process, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	err = cmd.Start()
+	// Only the process should hold the write end open.
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	p := &Process{
+		App:      app,
+		Pid:      cmd.Process.Pid,
+		lifeline: r,
+		exited:   make(chan struct{}),
+		owned:    true,
+	}
+	go func() {
+		// We are the parent so we need to reap the process.
+		cmd.Wait()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// adopt returns a Process for a process started by another dendron.
+func adopt(app string, pid int, lifeline *os.File) *Process {
+	p := &Process{App: app, Pid: pid, lifeline: lifeline, exited: make(chan struct{})}
+	go func() {
+		io.Copy(ioutil.Discard, lifeline)
+		close(p.exited)
+	}()
+	return p
+}
+
+// Exited returns a channel that is closed once the process has exited.
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Owned returns whether this dendron is responsible for stopping the process.
+// Adopted processes are owned once the handover has completed, and processes
+// are no longer owned once they have been handed over to a new dendron.
+func (p *Process) Owned() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.owned
+}
+
+func (p *Process) setOwned(owned bool) {
+	p.mutex.Lock()
+	p.owned = owned
+	p.mutex.Unlock()
+}
+
+// Signal sends sig to the process if it is still running.
+func (p *Process) Signal(sig syscall.Signal) error {
+	select {
+	case <-p.exited:
+		// The pid may have been reused by now.
+		return errors.New("handoff: process has already exited")
+	default:
+		return syscall.Kill(p.Pid, sig)
+	}
+}
+
+// state is the JSON encoded value of the DENDRON_HANDOFF variable.
+type state struct {
+	Listener  int            `json:"listener"`
+	Ready     int            `json:"ready"`
+	Processes []processState `json:"processes"`
+}
+
+type processState struct {
+	App      string `json:"app"`
+	Pid      int    `json:"pid"`
+	Lifeline int    `json:"lifeline"`
+}
+
+// An Inheritance is what a dendron was handed by the one that started it.
+type Inheritance struct {
+	Listener  net.Listener
+	processes map[string]*Process
+	claimed   map[string]bool
+	ready     *os.File
+}
+
+// Inherited returns what this dendron was handed, or nil if it wasn't started
+// by another dendron.
+func Inherited() (*Inheritance, error) {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envVar)
+
+	var s state
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		return nil, fmt.Errorf("handoff: invalid %s: %v", envVar, err)
+	}
+
+	file := inheritedFile(s.Listener, "listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("handoff: inherited listener: %v", err)
+	}
+
+	i := &Inheritance{
+		Listener:  listener,
+		processes: make(map[string]*Process),
+		claimed:   make(map[string]bool),
+		ready:     inheritedFile(s.Ready, "ready"),
+	}
+	for _, ps := range s.Processes {
+		i.processes[ps.App] = adopt(ps.App, ps.Pid, inheritedFile(ps.Lifeline, ps.App))
+	}
+	return i, nil
+}
+
+func inheritedFile(fd int, name string) *os.File {
+	// Don't pass the descriptor on to the processes we start.
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), name)
+}
+
+// Process returns the inherited process for app, or nil if there isn't one.
+// It is safe to call on a nil Inheritance.
+func (i *Inheritance) Process(app string) *Process {
+	if i == nil {
+		return nil
+	}
+	p := i.processes[app]
+	if p != nil {
+		i.claimed[app] = true
+	}
+	return p
+}
+
+// Ready tells the old dendron that this one is serving requests and takes
+// ownership of the inherited processes. It returns the inherited processes
+// that weren't claimed with Process, which the caller should stop.
+func (i *Inheritance) Ready() ([]*Process, error) {
+	var unclaimed []*Process
+	for app, p := range i.processes {
+		p.setOwned(true)
+		if !i.claimed[app] {
+			unclaimed = append(unclaimed, p)
+		}
+	}
+	_, err := i.ready.Write([]byte{1})
+	i.ready.Close()
+	return unclaimed, err
+}
+
+// fileListener is implemented by *net.TCPListener and *net.UnixListener.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// Upgrade starts the dendron binary at path with args, hands listener and
+// processes over to it and returns its pid. env is added to this process's
+// environment for the new dendron. It waits up to timeout for the new dendron
+// to be ready, after which the processes are no longer owned by this dendron
+// and the caller should stop accepting connections, drain and exit.
+// If the new dendron fails to become ready it is killed and an error returned,
+// leaving this dendron in charge.
+func Upgrade(path string, args, env []string, listener net.Listener, processes []*Process, timeout time.Duration) (pid int, err error) {
+	fl, ok := listener.(fileListener)
+	if !ok {
+		return 0, fmt.Errorf("handoff: can't hand over a %T", listener)
+	}
+	listenerFile, err := fl.File()
+	if err != nil {
+		return 0, err
+	}
+	defer listenerFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+
+	s := state{Listener: firstFD, Ready: firstFD + 1}
+	files := []*os.File{listenerFile, readyW}
+	for _, p := range processes {
+		select {
+		case <-p.exited:
+			continue
+		default:
+		}
+		s.Processes = append(s.Processes, processState{App: p.App, Pid: p.Pid, Lifeline: firstFD + len(files)})
+		files = append(files, p.lifeline)
+	}
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		readyW.Close()
+		return 0, err
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(append(os.Environ(), env...), envVar+"="+string(encoded))
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if _, err := readyR.Read(b[:]); err != nil {
+			result <- fmt.Errorf("handoff: new dendron exited before it was ready: %v", err)
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = fmt.Errorf("handoff: new dendron wasn't ready within %v", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+
+	for _, p := range processes {
+		p.setOwned(false)
+	}
+	if ul, ok := listener.(*net.UnixListener); ok {
+		// The new dendron is listening on the same socket file.
+		ul.SetUnlinkOnClose(false)
+	}
+	// The new dendron is not our child once we exit, so there's no need to
+	// wait for it.
+	pid = cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
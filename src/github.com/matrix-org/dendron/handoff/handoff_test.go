@@ -0,0 +1,122 @@
+package handoff
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess plays the part of the new dendron in TestUpgrade. It
+// adopts the "sleeper" process and replies to a connection on the inherited
+// listener with the process's pid.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("HANDOFF_TEST_HELPER") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	i, err := Inherited()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	p := i.Process("sleeper")
+	if _, err := i.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c, err := i.Listener.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(c, "%d %v", p.Pid, p.Owned())
+	c.Close()
+}
+
+func TestUpgrade(t *testing.T) {
+	p, err := Start("sleeper", exec.Command("sleep", "30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Signal(syscall.SIGKILL)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Upgrade(
+		os.Args[0], []string{"-test.run=^TestHelperProcess$"}, []string{"HANDOFF_TEST_HELPER=1"},
+		l, []*Process{p}, 10*time.Second,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Owned() {
+		t.Error("want the process to be owned by the new dendron")
+	}
+
+	// Stop accepting connections ourselves so that the new dendron gets it.
+	addr := l.Addr().String()
+	l.Close()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reply, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%d true", p.Pid); string(reply) != want {
+		t.Errorf("want %q from the new dendron got %q", want, reply)
+	}
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	p, err := Start("sleeper", exec.Command("sleep", "30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Signal(syscall.SIGKILL)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// false exits without becoming ready.
+	if _, err := Upgrade("false", nil, nil, l, []*Process{p}, 10*time.Second); err == nil {
+		t.Fatal("want an error when the new dendron exits")
+	}
+	if !p.Owned() {
+		t.Error("want the process to still be owned after a failed upgrade")
+	}
+}
+
+func TestLifeline(t *testing.T) {
+	p, err := Start("sleeper", exec.Command("sleep", "30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Watch the process through its lifeline as an adopting dendron would.
+	adopted := adopt(p.App, p.Pid, p.lifeline)
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-adopted.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("want the lifeline closed when the process exits")
+	}
+	if err := adopted.Signal(syscall.SIGTERM); err == nil {
+		t.Error("want an error signalling a process that has exited")
+	}
+}
@@ -0,0 +1,334 @@
+// Package login handles m.login.password logins natively by checking
+// passwords against synapse's database and issuing access tokens in it,
+// rather than passing the request to synapse. Logins that create a device are
+// still passed to synapse, since it has to tell the user's other devices and
+// the servers they share rooms with about the new one.
+package login
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/matrix-org/dendron/bodylimit"
+	"github.com/matrix-org/dendron/proxy"
+)
+
+const (
+	letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	base62  = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// request is the body of a login request.
+type request struct {
+	Type       string `json:"type"`
+	User       string `json:"user"`
+	Medium     string `json:"medium"`
+	Identifier *struct {
+		Type string `json:"type"`
+		User string `json:"user"`
+	} `json:"identifier"`
+	Password string `json:"password"`
+	DeviceID string `json:"device_id"`
+}
+
+// user returns the user the request is logging in as, or "" if it isn't a
+// password login for a matrix user ID.
+func (r *request) user() string {
+	if r.Type != "m.login.password" || r.Password == "" {
+		return ""
+	}
+	if r.Identifier != nil {
+		if r.Identifier.Type != "m.id.user" {
+			return ""
+		}
+		return r.Identifier.User
+	}
+	if r.Medium != "" {
+		return ""
+	}
+	return r.User
+}
+
+// A Handler logs users in with their password.
+// It implements prometheus.Collector to export how logins were handled.
+type Handler struct {
+	db         *sql.DB
+	serverName string
+	pepper     string
+	fallback   http.Handler
+
+	logins *prometheus.CounterVec
+}
+
+// NewHandler creates a Handler that uses synapse's database db for the server
+// serverName. pepper must match synapse's password_config.pepper. Requests it
+// can't handle natively, such as other login types, are passed to fallback.
+func NewHandler(db *sql.DB, serverName, pepper string, fallback http.Handler) *Handler {
+	return &Handler{
+		db:         db,
+		serverName: serverName,
+		pepper:     pepper,
+		fallback:   fallback,
+		logins: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_native_logins_total",
+				Help: "Number of login requests by whether they succeeded, failed or were passed on to synapse",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		h.fallback.ServeHTTP(w, req)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		bodylimit.ReplyTooLarge(w, err)
+		return
+	}
+	if err != nil {
+		proxy.LogAndReplyError(w, &proxy.HTTPError{
+			Err:        err,
+			StatusCode: 400,
+			ErrCode:    "M_NOT_JSON",
+			Message:    "Could not read request body",
+		})
+		return
+	}
+	fallback := func() {
+		h.logins.WithLabelValues("fallback").Inc()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.fallback.ServeHTTP(w, req)
+	}
+	var login request
+	if json.Unmarshal(body, &login) != nil || login.user() == "" || login.DeviceID == "" {
+		fallback()
+		return
+	}
+
+	userID, err := h.checkPassword(login.user(), login.Password)
+	if err != nil {
+		h.logins.WithLabelValues("error").Inc()
+		proxy.LogAndReplyError(w, &proxy.HTTPError{
+			Err:        err,
+			StatusCode: 500,
+			ErrCode:    "M_UNKNOWN",
+			Message:    "Internal server error",
+		})
+		return
+	}
+	if userID == "" {
+		h.logins.WithLabelValues("forbidden").Inc()
+		proxy.LogAndReplyError(w, &proxy.HTTPError{
+			Err:        fmt.Errorf("invalid password for %q", login.user()),
+			StatusCode: 403,
+			ErrCode:    "M_FORBIDDEN",
+			Message:    "Invalid password",
+		})
+		return
+	}
+
+	deviceID := login.DeviceID
+	token, err := h.issueToken(userID, deviceID)
+	if err != nil {
+		h.logins.WithLabelValues("error").Inc()
+		proxy.LogAndReplyError(w, &proxy.HTTPError{
+			Err:        err,
+			StatusCode: 500,
+			ErrCode:    "M_UNKNOWN",
+			Message:    "Internal server error",
+		})
+		return
+	}
+	if token == "" {
+		fallback()
+		return
+	}
+	h.logins.WithLabelValues("success").Inc()
+	log.WithFields(log.Fields{
+		"userID":   userID,
+		"deviceID": deviceID,
+	}).Info("Logged in natively")
+
+	proxy.SetHeaders(w)
+	json.NewEncoder(w).Encode(struct {
+		UserID      string `json:"user_id"`
+		AccessToken string `json:"access_token"`
+		HomeServer  string `json:"home_server"`
+		DeviceID    string `json:"device_id"`
+	}{userID, token, h.serverName, deviceID})
+}
+
+// userID returns the full user ID for user, which is either a localpart or a
+// user ID.
+func (h *Handler) userID(user string) string {
+	if strings.HasPrefix(user, "@") {
+		return user
+	}
+	return "@" + user + ":" + h.serverName
+}
+
+// checkPassword returns the ID of the user if password is theirs, or "" if
+// it isn't or the user doesn't exist.
+// Like synapse, user IDs are matched case insensitively unless several users
+// differ only by case, and passwords are NFKC normalised before hashing.
+func (h *Handler) checkPassword(user, password string) (string, error) {
+	wanted := h.userID(user)
+	rows, err := h.db.Query(
+		"SELECT name, password_hash FROM users WHERE lower(name) = lower($1)", wanted,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var hash sql.NullString
+		if err := rows.Scan(&name, &hash); err != nil {
+			return "", err
+		}
+		hashes[name] = hash.String
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	userID := wanted
+	if len(hashes) == 1 {
+		for name := range hashes {
+			userID = name
+		}
+	}
+	hash := hashes[userID]
+	// Deactivated and guest users don't have a password.
+	if hash == "" {
+		return "", nil
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(norm.NFKC.String(password)+h.pepper))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("login: checking password hash for %s: %v", userID, err)
+	}
+	return userID, nil
+}
+
+// issueToken stores a new access token for an existing device and returns it,
+// or returns "" if the user has no such device.
+// Synapse numbers access tokens from a counter it keeps in memory, so the
+// tokens issued here are numbered downwards from -1 to avoid its IDs.
+func (h *Handler) issueToken(userID, deviceID string) (token string, err error) {
+	token = generateToken(localpart(userID))
+	tx, err := h.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	if _, err = tx.Exec("LOCK TABLE access_tokens IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return "", err
+	}
+	// The device is locked so that it can't be deleted, along with its
+	// tokens, before the new token is stored.
+	var exists int
+	err = tx.QueryRow(
+		"SELECT 1 FROM devices WHERE user_id = $1 AND device_id = $2 FOR SHARE",
+		userID, deviceID,
+	).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec(
+		"INSERT INTO access_tokens (id, user_id, device_id, token)"+
+			" SELECT LEAST(COALESCE(MIN(id), 0), 0) - 1, $1, $2, $3 FROM access_tokens",
+		userID, deviceID, token,
+	); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// localpart returns the localpart of userID.
+func localpart(userID string) string {
+	localpart := strings.TrimPrefix(userID, "@")
+	if i := strings.IndexByte(localpart, ':'); i >= 0 {
+		localpart = localpart[:i]
+	}
+	return localpart
+}
+
+// generateToken returns a new access token for the user with localpart in
+// synapse's format: "syt_", the URL safe base64 localpart, a random string
+// and a checksum.
+func generateToken(localpart string) string {
+	base := "syt_" + base64.RawURLEncoding.EncodeToString([]byte(localpart)) + "_" + randomString(20)
+	return base + "_" + base62Encode(crc32.ChecksumIEEE([]byte(base)), 6)
+}
+
+// base62Encode encodes n in base 62, padded with zeros to at least width.
+func base62Encode(n uint32, width int) string {
+	var digits []byte
+	for n > 0 {
+		digits = append([]byte{base62[n%62]}, digits...)
+		n /= 62
+	}
+	for len(digits) < width {
+		digits = append([]byte{'0'}, digits...)
+	}
+	return string(digits)
+}
+
+// randomString returns n random letters.
+func randomString(n int) string {
+	max := big.NewInt(int64(len(letters)))
+	b := make([]byte, n)
+	for i := range b {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = letters[j.Int64()]
+	}
+	return string(b)
+}
+
+// Describe implements prometheus.Collector
+func (h *Handler) Describe(ch chan<- *prometheus.Desc) {
+	h.logins.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (h *Handler) Collect(ch chan<- prometheus.Metric) {
+	h.logins.Collect(ch)
+}
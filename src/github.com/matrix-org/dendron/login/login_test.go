@@ -0,0 +1,191 @@
+package login
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testDB connects to the postgres database in $DENDRON_TEST_POSTGRES, e.g.
+// "postgres://localhost/dendron_test?sslmode=disable", and creates the parts
+// of synapse's schema used for logging in as temporary tables.
+func testDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("DENDRON_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("DENDRON_TEST_POSTGRES isn't set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Temporary tables only exist on the connection that created them.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`CREATE TEMP TABLE users (name TEXT, password_hash TEXT, UNIQUE(name))`,
+		`CREATE TEMP TABLE devices (user_id TEXT NOT NULL, device_id TEXT NOT NULL, display_name TEXT, UNIQUE(user_id, device_id))`,
+		`CREATE TEMP TABLE access_tokens (id BIGINT PRIMARY KEY, user_id TEXT NOT NULL, device_id TEXT, token TEXT NOT NULL, last_used BIGINT, UNIQUE(token))`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func addUser(t *testing.T, db *sql.DB, name, password string) {
+	var hash interface{}
+	if password != "" {
+		b, err := bcrypt.GenerateFromPassword([]byte(password+"pepper"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash = string(b)
+	}
+	if _, err := db.Exec("INSERT INTO users (name, password_hash) VALUES ($1, $2)", name, hash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addDevice(t *testing.T, db *sql.DB, userID, deviceID string) {
+	if _, err := db.Exec("INSERT INTO devices (user_id, device_id) VALUES ($1, $2)", userID, deviceID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func login(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/_matrix/client/r0/login", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	addUser(t, db, "@alice:example.org", "secret")
+	addUser(t, db, "@deactivated:example.org", "")
+	// Synapse hashes the NFKC normalised password.
+	addUser(t, db, "@bob:example.org", "caf\u00e9")
+	addDevice(t, db, "@alice:example.org", "PHONE")
+	addDevice(t, db, "@bob:example.org", "LAPTOP")
+	h := NewHandler(db, "example.org", "pepper", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(299)
+	}))
+
+	w := login(h, `{"type":"m.login.password","identifier":{"type":"m.id.user","user":"Alice"},"password":"secret","device_id":"PHONE"}`)
+	if w.Code != 200 {
+		t.Fatalf("want 200 got %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		UserID      string `json:"user_id"`
+		AccessToken string `json:"access_token"`
+		DeviceID    string `json:"device_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.UserID != "@alice:example.org" || resp.DeviceID != "PHONE" {
+		t.Errorf("unexpected response %s", w.Body)
+	}
+	var id int64
+	var userID, deviceID string
+	if err := db.QueryRow("SELECT id, user_id, device_id FROM access_tokens WHERE token = $1", resp.AccessToken).Scan(&id, &userID, &deviceID); err != nil {
+		t.Fatal(err)
+	}
+	if id != -1 || userID != resp.UserID || deviceID != resp.DeviceID {
+		t.Errorf("unexpected token row %d %s %s", id, userID, deviceID)
+	}
+
+	// Logging in again on the same device issues another token.
+	w = login(h, `{"type":"m.login.password","user":"@alice:example.org","password":"secret","device_id":"`+deviceID+`"}`)
+	if w.Code != 200 {
+		t.Fatalf("same device: want 200 got %d %s", w.Code, w.Body)
+	}
+	if err := db.QueryRow("SELECT MIN(id) FROM access_tokens").Scan(&id); err != nil || id != -2 {
+		t.Errorf("want the second token numbered -2 got %d %v", id, err)
+	}
+
+	// Synapse creates new devices, so logins for them are passed on.
+	if w := login(h, `{"type":"m.login.password","user":"alice","password":"secret","device_id":"TABLET"}`); w.Code != 299 {
+		t.Errorf("new device: want the request passed on got %d %s", w.Code, w.Body)
+	}
+	var tokens int
+	if err := db.QueryRow("SELECT COUNT(*) FROM access_tokens").Scan(&tokens); err != nil || tokens != 2 {
+		t.Errorf("new device: want no token issued got %d tokens %v", tokens, err)
+	}
+
+	// The password is normalised before it is checked.
+	if w := login(h, `{"type":"m.login.password","user":"bob","password":"cafe\u0301","device_id":"LAPTOP"}`); w.Code != 200 {
+		t.Errorf("decomposed password: want 200 got %d %s", w.Code, w.Body)
+	}
+
+	for _, body := range []string{
+		`{"type":"m.login.password","user":"alice","password":"wrong","device_id":"PHONE"}`,
+		`{"type":"m.login.password","user":"nobody","password":"secret","device_id":"PHONE"}`,
+		`{"type":"m.login.password","user":"deactivated","password":"secret","device_id":"PHONE"}`,
+	} {
+		if w := login(h, body); w.Code != 403 {
+			t.Errorf("%s: want 403 got %d", body, w.Code)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	// Requests that fall back never touch the database.
+	h := NewHandler(nil, "example.org", "", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(299)
+	}))
+	for _, body := range []string{
+		`{"type":"m.login.token","token":"abc"}`,
+		`{"type":"m.login.password","user":"alice","password":"secret"}`,
+		`{"type":"m.login.password","identifier":{"type":"m.id.thirdparty","medium":"email","address":"a@b.c"},"password":"secret"}`,
+		`{"type":"m.login.password","medium":"email","address":"a@b.c","password":"secret"}`,
+		`not json`,
+	} {
+		if w := login(h, body); w.Code != 299 {
+			t.Errorf("%s: want the request passed on got %d", body, w.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "/_matrix/client/r0/login", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 299 {
+		t.Errorf("GET: want the request passed on got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/_matrix/client/r0/login", strings.NewReader(`{"password":"`+strings.Repeat("a", 100)+`"}`))
+	w = httptest.NewRecorder()
+	req.Body = http.MaxBytesReader(w, req.Body, 10)
+	h.ServeHTTP(w, req)
+	if w.Code != 413 {
+		t.Errorf("body over the limit: want 413 got %d", w.Code)
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	token := generateToken("alice")
+	if !regexp.MustCompile(`^syt_YWxpY2U_[a-zA-Z]{20}_[0-9a-zA-Z]{6}$`).MatchString(token) {
+		t.Fatalf("unexpected token %s", token)
+	}
+	i := strings.LastIndexByte(token, '_')
+	if want := base62Encode(crc32.ChecksumIEEE([]byte(token[:i])), 6); token[i+1:] != want {
+		t.Errorf("checksum: want %s got %s", want, token[i+1:])
+	}
+	// The localpart is encoded with the URL safe alphabet.
+	if token := generateToken("a>?"); !strings.HasPrefix(token, "syt_YT4_") {
+		t.Errorf("want the localpart URL safe encoded got %s", token)
+	}
+	if got := base62Encode(62*62+1, 6); got != "000101" {
+		t.Errorf("base62Encode: want 000101 got %s", got)
+	}
+}
@@ -0,0 +1,428 @@
+// Package loginguard protects accounts from password guessing by locking out
+// usernames and client IPs that fail to log in too often.
+package loginguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendron/bodylimit"
+	"github.com/matrix-org/dendron/clientip"
+	"github.com/matrix-org/dendron/proxy"
+)
+
+// maxTracked is how many usernames and IPs failures are remembered for.
+// Those that are locked out are kept until the lockout is over regardless, so
+// that they can't be pushed out by failures for others.
+const maxTracked = 100000
+
+// loginPath matches the login endpoint on both client API prefixes.
+var loginPath = regexp.MustCompile(`^/_matrix/client/(r0|api/v1)/login$`)
+
+// Options configure when a Guard locks out a username or IP.
+type Options struct {
+	// Threshold is how many failures in a row are allowed before a lockout.
+	Threshold int
+	// Lockout is how long the first lockout lasts. Each failure after that
+	// doubles it.
+	Lockout time.Duration
+	// MaxLockout is the longest a lockout can last.
+	MaxLockout time.Duration
+	// Window is how long after its last failure a username or IP is
+	// forgotten.
+	Window time.Duration
+}
+
+// A record is the recent failures for a username or IP.
+type record struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// A Guard watches the responses to login requests and refuses logins for
+// usernames and client IPs that have failed too often, without asking synapse.
+// It implements prometheus.Collector to export failures and lockouts.
+type Guard struct {
+	opts    Options
+	mutex   sync.Mutex
+	records *lru.Cache
+	locked  map[string]*record
+	sweepAt int
+	now     func() time.Time
+
+	failures prometheus.Counter
+	lockouts *prometheus.CounterVec
+	refused  *prometheus.CounterVec
+}
+
+// NewGuard creates a Guard that locks out according to opts.
+func NewGuard(opts Options) (*Guard, error) {
+	if opts.Threshold < 1 {
+		return nil, fmt.Errorf("loginguard: threshold must be at least 1, got %d", opts.Threshold)
+	}
+	records, err := lru.New(maxTracked)
+	if err != nil {
+		return nil, err
+	}
+	return &Guard{
+		opts:    opts,
+		records: records,
+		locked:  make(map[string]*record),
+		now:     time.Now,
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dendron_login_failures_total",
+			Help: "Number of failed logins",
+		}),
+		lockouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_login_lockouts_total",
+				Help: "Number of times a username or client IP was locked out after failing to log in",
+			},
+			[]string{"key"},
+		),
+		refused: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_login_locked_out_requests_total",
+				Help: "Number of logins refused because the username or client IP was locked out",
+			},
+			[]string{"key"},
+		),
+	}, nil
+}
+
+// username returns the normalised username a login request body is for, or
+// "" if it doesn't have one, and whether it is a password login. Other types
+// of login aren't guessable so aren't counted or locked out.
+func username(body []byte) (string, bool) {
+	var login struct {
+		Type       string `json:"type"`
+		User       string `json:"user"`
+		Medium     string `json:"medium"`
+		Address    string `json:"address"`
+		Identifier struct {
+			Type    string `json:"type"`
+			User    string `json:"user"`
+			Medium  string `json:"medium"`
+			Address string `json:"address"`
+		} `json:"identifier"`
+	}
+	if err := json.Unmarshal(body, &login); err != nil || login.Type != "m.login.password" {
+		return "", false
+	}
+	name := login.Identifier.User
+	if name == "" {
+		name = login.Identifier.Address
+	}
+	if name == "" {
+		name = login.User
+	}
+	if name == "" {
+		name = login.Address
+	}
+	// "@alice:example.org" and "alice" are the same account.
+	if strings.HasPrefix(name, "@") {
+		name = name[1:]
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[:i]
+		}
+	}
+	return strings.ToLower(name), true
+}
+
+// keys returns the keys failures of req are counted under, along with whether
+// each is a "user" or "ip".
+func keys(name, ip string) ([]string, []string) {
+	var keys, types []string
+	if name != "" {
+		keys, types = append(keys, "user:"+name), append(types, "user")
+	}
+	if ip != "" {
+		keys, types = append(keys, "ip:"+ip), append(types, "ip")
+	}
+	return keys, types
+}
+
+// get returns the record for key, or nil if there isn't one. A record whose
+// lockout is over goes back to being evicted like any other.
+func (g *Guard) get(key string, now time.Time) *record {
+	if r, ok := g.locked[key]; ok {
+		if now.Before(r.lockedUntil) {
+			return r
+		}
+		delete(g.locked, key)
+		g.records.Add(key, r)
+		return r
+	}
+	if value, ok := g.records.Get(key); ok {
+		return value.(*record)
+	}
+	return nil
+}
+
+// lock keeps the record for key from being evicted until its lockout is over.
+// Lockouts that are over are swept out whenever the number kept doubles.
+func (g *Guard) lock(key string, r *record, now time.Time) {
+	g.records.Remove(key)
+	g.locked[key] = r
+	if len(g.locked) < g.sweepAt {
+		return
+	}
+	for k, l := range g.locked {
+		if !now.Before(l.lockedUntil) {
+			delete(g.locked, k)
+			g.records.Add(k, l)
+		}
+	}
+	g.sweepAt = 2 * len(g.locked)
+}
+
+// remove forgets the record for key, and returns whether there was one.
+func (g *Guard) remove(key string) bool {
+	_, found := g.locked[key]
+	found = found || g.records.Contains(key)
+	delete(g.locked, key)
+	g.records.Remove(key)
+	return found
+}
+
+// lockedOut returns how much longer the longest lockout of keys lasts and
+// which type of key it is for, or zero if none of them are locked out.
+func (g *Guard) lockedOut(keys, types []string) (time.Duration, string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.now()
+	var longest time.Duration
+	var keyType string
+	for i, key := range keys {
+		r := g.get(key, now)
+		if r == nil {
+			continue
+		}
+		if wait := r.lockedUntil.Sub(now); wait > longest {
+			longest, keyType = wait, types[i]
+		}
+	}
+	return longest, keyType
+}
+
+// fail counts a failed login against keys, locking them out once they reach
+// the threshold.
+func (g *Guard) fail(keys, types []string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.now()
+	g.failures.Inc()
+	for i, key := range keys {
+		r := g.get(key, now)
+		if r == nil || now.Sub(r.lastFailure) >= g.opts.Window {
+			g.remove(key)
+			r = &record{}
+			g.records.Add(key, r)
+		}
+		r.failures++
+		r.lastFailure = now
+		if r.failures < g.opts.Threshold {
+			continue
+		}
+		lockout := g.opts.Lockout
+		for n := r.failures - g.opts.Threshold; n > 0 && lockout < g.opts.MaxLockout; n-- {
+			lockout *= 2
+		}
+		if lockout > g.opts.MaxLockout {
+			lockout = g.opts.MaxLockout
+		}
+		r.lockedUntil = now.Add(lockout)
+		g.lock(key, r, now)
+		g.lockouts.WithLabelValues(types[i]).Inc()
+		log.WithFields(log.Fields{
+			"key":      key,
+			"failures": r.failures,
+			"lockout":  lockout,
+		}).Warn("Locking out login after repeated failures")
+	}
+}
+
+// succeed forgets the failures for the username of a successful login. The
+// IP's failures are kept so that one working account can't be used to keep
+// guessing the passwords of others.
+func (g *Guard) succeed(name string) {
+	if name == "" {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.remove("user:" + name)
+}
+
+// Handler wraps next so that password logins for locked out usernames and IPs
+// are refused with M_LIMIT_EXCEEDED, and the results of other password logins
+// are counted. Other types of login are passed straight through. It must be wrapped by a clientip.Resolver's Handler so that the
+// client IP is known.
+func (g *Guard) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || !loginPath.MatchString(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			// The body is limited by bodylimit, so the error is reported
+			// the same way as it is by the proxy.
+			bodylimit.ReplyTooLarge(w, err)
+			return
+		}
+		if err != nil {
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        err,
+				StatusCode: 400,
+				ErrCode:    "M_NOT_JSON",
+				Message:    "Could not read request body",
+			})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		name, isPassword := username(body)
+		if !isPassword {
+			next.ServeHTTP(w, req)
+			return
+		}
+		keys, types := keys(name, clientip.FromRequest(req))
+		if wait, keyType := g.lockedOut(keys, types); wait > 0 {
+			g.refused.WithLabelValues(keyType).Inc()
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        fmt.Errorf("login locked out for %s", keyType),
+				StatusCode: 429,
+				ErrCode:    "M_LIMIT_EXCEEDED",
+				Message:    "Too many failed login attempts",
+				RetryAfter: wait,
+			})
+			return
+		}
+
+		recorder := &proxy.StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+		switch recorder.Status {
+		case http.StatusOK:
+			g.succeed(name)
+		case http.StatusForbidden:
+			g.fail(keys, types)
+		}
+	})
+}
+
+// A Lockout is the state of a username or IP with recent failures, as
+// reported by the admin API.
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// Lockouts returns the usernames and IPs with recent failures.
+func (g *Guard) Lockouts() []Lockout {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.now()
+	records := make(map[string]*record, len(g.locked))
+	for key, r := range g.locked {
+		records[key] = r
+	}
+	for _, key := range g.records.Keys() {
+		if value, ok := g.records.Peek(key); ok {
+			records[key.(string)] = value.(*record)
+		}
+	}
+	lockouts := []Lockout{}
+	for key, r := range records {
+		if now.Sub(r.lastFailure) >= g.opts.Window && now.After(r.lockedUntil) {
+			continue
+		}
+		l := Lockout{Key: key, Failures: r.failures, LastFailure: r.lastFailure}
+		if now.Before(r.lockedUntil) {
+			l.LockedUntil = r.lockedUntil
+		}
+		lockouts = append(lockouts, l)
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+	return lockouts
+}
+
+// Clear forgets the failures for key, e.g. "user:alice" or "ip:203.0.113.1",
+// and returns whether there were any.
+func (g *Guard) Clear(key string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.remove(key) {
+		return false
+	}
+	log.WithField("key", key).Info("Cleared login lockout")
+	return true
+}
+
+// AdminHandler serves the admin API for lockouts under prefix:
+//
+//	GET    prefix           lists the usernames and IPs with recent failures
+//	DELETE prefix/{key}     clears a username or IP
+func (g *Guard) AdminHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		switch {
+		case key == "" && req.Method == "GET":
+			proxy.SetHeaders(w)
+			json.NewEncoder(w).Encode(struct {
+				Lockouts []Lockout `json:"lockouts"`
+			}{g.Lockouts()})
+		case key != "" && req.Method == "DELETE":
+			if !g.Clear(key) {
+				proxy.LogAndReplyError(w, &proxy.HTTPError{
+					Err:        fmt.Errorf("no login failures for %q", key),
+					StatusCode: 404,
+					ErrCode:    "M_NOT_FOUND",
+					Message:    "No login failures for that key",
+				})
+				return
+			}
+			proxy.SetHeaders(w)
+			w.Write([]byte("{}"))
+		default:
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        fmt.Errorf("unsupported %s %s", req.Method, req.URL.Path),
+				StatusCode: 405,
+				ErrCode:    "M_UNRECOGNIZED",
+				Message:    "Unrecognized request",
+			})
+		}
+	})
+}
+
+// Describe implements prometheus.Collector
+func (g *Guard) Describe(ch chan<- *prometheus.Desc) {
+	g.failures.Describe(ch)
+	g.lockouts.Describe(ch)
+	g.refused.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (g *Guard) Collect(ch chan<- prometheus.Metric) {
+	g.failures.Collect(ch)
+	g.lockouts.Collect(ch)
+	g.refused.Collect(ch)
+}
@@ -0,0 +1,227 @@
+package loginguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// fakeSynapse accepts logins for alice with the password "right".
+func fakeSynapse(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*calls++
+		body, _ := ioutil.ReadAll(req.Body)
+		if name, _ := username(body); name == "alice" && strings.Contains(string(body), `"password":"right"`) {
+			w.Write([]byte(`{"user_id":"@alice:example.org"}`))
+			return
+		}
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode":"M_FORBIDDEN"}`))
+	})
+}
+
+func TestGuard(t *testing.T) {
+	g, err := NewGuard(Options{Threshold: 2, Lockout: time.Minute, MaxLockout: 3 * time.Minute, Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+	var calls int
+	h := g.Handler(fakeSynapse(&calls))
+
+	login := func(user, password, remoteAddr string) *httptest.ResponseRecorder {
+		body := `{"type":"m.login.password","identifier":{"type":"m.id.user","user":"` + user + `"},"password":"` + password + `"}`
+		req := httptest.NewRequest("POST", "/_matrix/client/r0/login", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := login("alice", "wrong", "203.0.113.1:1"); w.Code != 403 {
+			t.Fatalf("failure %d: want 403 got %d", i, w.Code)
+		}
+	}
+	// The username is locked out from any IP, without asking synapse.
+	w := login("@Alice:example.org", "right", "198.51.100.1:1")
+	if w.Code != 429 || calls != 2 {
+		t.Fatalf("locked out: want 429 without calling synapse got %d after %d calls", w.Code, calls)
+	}
+	var body struct {
+		ErrCode      string `json:"errcode"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ErrCode != "M_LIMIT_EXCEEDED" || body.RetryAfterMs != 60000 {
+		t.Errorf("want M_LIMIT_EXCEEDED with retry_after_ms 60000 got %s", w.Body)
+	}
+	// So is the IP, for any username.
+	if w := login("bob", "wrong", "203.0.113.1:1"); w.Code != 429 {
+		t.Errorf("locked out IP: want 429 got %d", w.Code)
+	}
+
+	// Each failure after the lockout doubles it, up to the maximum.
+	now = now.Add(time.Minute)
+	login("alice", "wrong", "198.51.100.2:1")
+	if wait, _ := g.lockedOut([]string{"user:alice"}, []string{"user"}); wait != 2*time.Minute {
+		t.Errorf("second lockout: want 2m got %v", wait)
+	}
+	now = now.Add(2 * time.Minute)
+	login("alice", "wrong", "198.51.100.3:1")
+	if wait, _ := g.lockedOut([]string{"user:alice"}, []string{"user"}); wait != 3*time.Minute {
+		t.Errorf("third lockout: want the 3m maximum got %v", wait)
+	}
+
+	// Success forgets the username's failures.
+	now = now.Add(3 * time.Minute)
+	if w := login("alice", "right", "198.51.100.4:1"); w.Code != 200 {
+		t.Fatalf("after the lockout: want 200 got %d", w.Code)
+	}
+	if w := login("alice", "wrong", "198.51.100.4:1"); w.Code != 403 {
+		t.Errorf("after success: want 403 got %d", w.Code)
+	}
+}
+
+func TestGuardOnlyPasswordLogins(t *testing.T) {
+	g, err := NewGuard(Options{Threshold: 1, Lockout: time.Minute, MaxLockout: time.Minute, Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	h := g.Handler(fakeSynapse(&calls))
+	login := func(body string) int {
+		req := httptest.NewRequest("POST", "/_matrix/client/r0/login", strings.NewReader(body))
+		req.RemoteAddr = "203.0.113.1:1"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Failed token logins aren't counted.
+	token := `{"type":"m.login.token","token":"expired"}`
+	for i := 0; i < 3; i++ {
+		if code := login(token); code != 403 {
+			t.Fatalf("token login %d: want 403 got %d", i, code)
+		}
+	}
+	if code := login(`{"type":"m.login.password","user":"alice","password":"wrong"}`); code != 403 {
+		t.Fatalf("password login: want 403 got %d", code)
+	}
+	// Nor are they refused once the IP is locked out.
+	if code := login(token); code != 403 || calls != 5 {
+		t.Errorf("token login from a locked out IP: want 403 from synapse got %d after %d calls", code, calls)
+	}
+}
+
+func TestGuardKeepsLockouts(t *testing.T) {
+	g, err := NewGuard(Options{Threshold: 2, Lockout: time.Minute, MaxLockout: time.Minute, Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+	if g.records, err = lru.New(2); err != nil {
+		t.Fatal(err)
+	}
+	alice := []string{"user:alice"}
+	mallory := func(n int) {
+		for i := 0; i < n; i++ {
+			g.fail([]string{fmt.Sprintf("user:mallory%d", i)}, []string{"user"})
+		}
+	}
+
+	g.fail(alice, []string{"user"})
+	g.fail(alice, []string{"user"})
+	// Failures for more usernames than are tracked can't evict the lockout.
+	mallory(5)
+	if wait, _ := g.lockedOut(alice, []string{"user"}); wait != time.Minute {
+		t.Errorf("want alice still locked out for 1m got %v", wait)
+	}
+
+	// Once the lockout is over the record can be evicted again.
+	now = now.Add(time.Minute)
+	g.lockedOut(alice, []string{"user"})
+	mallory(2)
+	if _, locked := g.locked["user:alice"]; locked || g.records.Contains("user:alice") {
+		t.Errorf("want alice evicted after the lockout got %v locked and %v tracked", locked, g.records.Keys())
+	}
+}
+
+func TestGuardBodyTooLarge(t *testing.T) {
+	g, err := NewGuard(Options{Threshold: 2, Lockout: time.Minute, MaxLockout: time.Minute, Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	h := g.Handler(fakeSynapse(&calls))
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/_matrix/client/r0/login", strings.NewReader(`{"password":"`+strings.Repeat("a", 100)+`"}`))
+	req.Body = http.MaxBytesReader(w, req.Body, 10)
+	h.ServeHTTP(w, req)
+	if w.Code != 413 || calls != 0 {
+		t.Errorf("want 413 without calling synapse got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	g, err := NewGuard(Options{Threshold: 1, Lockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.fail([]string{"user:alice", "ip:203.0.113.1"}, []string{"user", "ip"})
+	admin := g.AdminHandler("/_dendron/admin/login_lockouts")
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/_dendron/admin/login_lockouts", nil))
+	var list struct {
+		Lockouts []Lockout `json:"lockouts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Lockouts) != 2 || list.Lockouts[0].Key != "ip:203.0.113.1" || list.Lockouts[1].LockedUntil.IsZero() {
+		t.Errorf("unexpected lockouts %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/_dendron/admin/login_lockouts/user:alice", nil))
+	if w.Code != 200 {
+		t.Errorf("clearing: want 200 got %d", w.Code)
+	}
+	if wait, _ := g.lockedOut([]string{"user:alice"}, []string{"user"}); wait != 0 {
+		t.Errorf("want alice cleared got %v", wait)
+	}
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/_dendron/admin/login_lockouts/user:alice", nil))
+	if w.Code != 404 {
+		t.Errorf("clearing again: want 404 got %d", w.Code)
+	}
+}
+
+func TestUsername(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"type":"m.login.password","user":"Alice"}`:                                                             "alice",
+		`{"type":"m.login.password","identifier":{"type":"m.id.user","user":"@bob:example.org"}}`:                "bob",
+		`{"type":"m.login.password","identifier":{"type":"m.id.thirdparty","medium":"email","address":"c@d.e"}}`: "c@d.e",
+	} {
+		if got, ok := username([]byte(body)); got != want || !ok {
+			t.Errorf("%s: want password login for %q got %q, %v", body, want, got, ok)
+		}
+	}
+	for _, body := range []string{`{"type":"m.login.token","token":"abc"}`, `{"user":"alice"}`, `not json`} {
+		if _, ok := username([]byte(body)); ok {
+			t.Errorf("%s: want not a password login", body)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package media
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// A ThumbnailCache keeps generated thumbnails on disk, removing the least
+// recently used once they take up more than a maximum number of bytes.
+type ThumbnailCache struct {
+	dir      string
+	maxBytes int64
+
+	mutex   sync.Mutex
+	entries *simplelru.LRU
+	bytes   int64
+}
+
+// NewThumbnailCache creates a ThumbnailCache in dir, which holds up to
+// maxBytes of thumbnails. Thumbnails already in dir are kept, with the most
+// recently modified treated as the most recently used.
+func NewThumbnailCache(dir string, maxBytes int64) (*ThumbnailCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &ThumbnailCache{dir: dir, maxBytes: maxBytes}
+	var err error
+	// The cache is bounded by size rather than count.
+	if c.entries, err = simplelru.NewLRU(1<<31-1, c.evicted); err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	var paths []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// Left behind by a write that didn't finish.
+			return os.Remove(path)
+		}
+		files = append(files, info)
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return files[order[i]].ModTime().Before(files[order[j]].ModTime())
+	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, i := range order {
+		c.entries.Add(paths[i], files[i].Size())
+		c.bytes += files[i].Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// path returns where the thumbnail called name for mediaID is kept.
+func (c *ThumbnailCache) path(mediaID, name string) string {
+	return filepath.Join(c.dir, mediaID[0:2], mediaID[2:4], name)
+}
+
+// Open opens the thumbnail called name for mediaID, returning nil if it isn't
+// cached.
+func (c *ThumbnailCache) Open(mediaID, name string) (*os.File, error) {
+	path := c.path(mediaID, name)
+	c.mutex.Lock()
+	_, ok := c.entries.Get(path)
+	c.mutex.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		c.mutex.Lock()
+		c.entries.Remove(path)
+		c.mutex.Unlock()
+		return nil, nil
+	}
+	return f, err
+}
+
+// Put stores data as the thumbnail called name for mediaID.
+func (c *ThumbnailCache) Put(mediaID, name string, data []byte) error {
+	path := c.path(mediaID, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Replacing an entry mustn't remove the file that was just written.
+	if old, ok := c.entries.Peek(path); ok {
+		c.bytes -= old.(int64)
+	}
+	c.entries.Add(path, int64(len(data)))
+	c.bytes += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// Bytes returns the size of the cached thumbnails.
+func (c *ThumbnailCache) Bytes() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.bytes
+}
+
+// evict removes the least recently used thumbnails until the cache fits. The
+// mutex must be held.
+func (c *ThumbnailCache) evict() {
+	for c.bytes > c.maxBytes && c.entries.Len() > 0 {
+		c.entries.RemoveOldest()
+	}
+}
+
+// evicted is called with the mutex held when a thumbnail leaves the cache.
+func (c *ThumbnailCache) evicted(key, value interface{}) {
+	c.bytes -= value.(int64)
+	os.Remove(key.(string))
+}
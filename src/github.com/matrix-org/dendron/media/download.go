@@ -0,0 +1,144 @@
+package media
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// downloadPath matches /_matrix/media/{version}/download/{serverName}/{mediaId}
+// with an optional file name.
+var downloadPath = regexp.MustCompile(`^/_matrix/media/[^/]+/download/([^/]+)/([^/]+)(?:/([^/]+))?$`)
+
+// A DownloadHandler serves downloads of local media from the media store.
+// Remote media, and media it can't find or read, are passed to a fallback.
+// It implements prometheus.Collector to export how downloads were handled.
+type DownloadHandler struct {
+	store    *Store
+	fallback http.Handler
+
+	downloads *prometheus.CounterVec
+}
+
+// NewDownloadHandler creates a DownloadHandler that serves from store and
+// passes other requests to fallback.
+func NewDownloadHandler(store *Store, fallback http.Handler) *DownloadHandler {
+	return &DownloadHandler{
+		store:    store,
+		fallback: fallback,
+		downloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_media_downloads_total",
+				Help: "Number of media downloads by whether they were served natively or passed to the media repository",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (h *DownloadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.serve(w, req) {
+		h.downloads.WithLabelValues("fallback").Inc()
+		h.fallback.ServeHTTP(w, req)
+	}
+}
+
+// serve serves req natively, returning false if it needs to fall back.
+func (h *DownloadHandler) serve(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	match := downloadPath.FindStringSubmatch(req.URL.Path)
+	if match == nil || !h.store.IsLocal(match[1]) {
+		return false
+	}
+	mediaID, fileName := match[2], match[3]
+
+	m, err := h.store.localMedia(mediaID)
+	if err != nil || m == nil {
+		logError(mediaID, err)
+		return false
+	}
+	f, err := h.store.open(m)
+	if err != nil || f == nil {
+		logError(mediaID, err)
+		return false
+	}
+	defer f.Close()
+
+	if fileName == "" {
+		fileName = m.uploadName
+	}
+	setHeaders(w, m.mediaType, fileName)
+	h.downloads.WithLabelValues("native").Inc()
+	http.ServeContent(w, req, "", m.created, f)
+	return true
+}
+
+// logError logs err, if there is one, from serving mediaID natively.
+func logError(mediaID string, err error) {
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mediaID": mediaID,
+			"error":   err,
+		}).Warn("Failed to serve media natively")
+	}
+}
+
+// setHeaders sets the headers synapse sets when serving a file.
+func setHeaders(w http.ResponseWriter, mediaType, fileName string) {
+	if strings.HasPrefix(mediaType, "text/") && !strings.Contains(strings.ToLower(mediaType), "charset") {
+		mediaType += "; charset=UTF-8"
+	}
+	w.Header().Set("Content-Type", mediaType)
+	if fileName != "" {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", fileName))
+	}
+	w.Header().Set("Cache-Control", "public,max-age=86400,s-maxage=86400")
+}
+
+// contentDisposition returns a Content-Disposition header value of the given
+// type for a file called fileName. Plain ASCII names are given as a quoted
+// string and other names are encoded as described in RFC 6266.
+func contentDisposition(dispositionType, fileName string) string {
+	for i := 0; i < len(fileName); i++ {
+		if c := fileName[i]; c < 0x20 || c >= 0x7f {
+			return dispositionType + "; filename*=utf-8''" + encodeExtValue(fileName)
+		}
+	}
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fileName)
+	return dispositionType + `; filename="` + quoted + `"`
+}
+
+// encodeExtValue percent-encodes every byte of s that isn't an attr-char
+// from RFC 5987.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// Describe implements prometheus.Collector
+func (h *DownloadHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.downloads.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (h *DownloadHandler) Collect(ch chan<- prometheus.Metric) {
+	h.downloads.Collect(ch)
+}
@@ -0,0 +1,395 @@
+package media
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// testStore creates a Store in a temporary directory with the given media.
+func testStore(t *testing.T, media map[string]*localMedia, files map[string]string) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(nil, dir, "example.org")
+	s.lookup = func(mediaID string) (*localMedia, error) {
+		return media[mediaID], nil
+	}
+	for mediaID, content := range files {
+		path := s.localMediaPath(mediaID)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestDownload(t *testing.T) {
+	s, cleanup := testStore(t, map[string]*localMedia{
+		"abcdefgh": {mediaID: "abcdefgh", mediaType: "text/plain", uploadName: "hello world.txt", created: time.Unix(1000, 0)},
+		"nofile00": {mediaID: "nofile00", mediaType: "image/png"},
+	}, map[string]string{
+		"abcdefgh": "hello world",
+	})
+	defer cleanup()
+	h := NewDownloadHandler(s, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(299)
+	}))
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/_matrix/media/r0/download/example.org/abcdefgh", nil)
+	if w.Code != 200 || w.Body.String() != "hello world" {
+		t.Fatalf("want 200 hello world got %d %q", w.Code, w.Body)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":        "text/plain; charset=UTF-8",
+		"Content-Disposition": `inline; filename="hello world.txt"`,
+		"Content-Length":      "11",
+		"Accept-Ranges":       "bytes",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s: want %q got %q", header, want, got)
+		}
+	}
+
+	w = get("/_matrix/media/v1/download/example.org/abcdefgh/héllo.txt", http.Header{"Range": {"bytes=6-"}})
+	if w.Code != 206 || w.Body.String() != "world" {
+		t.Errorf("range: want 206 world got %d %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "inline; filename*=utf-8''h%C3%A9llo.txt" {
+		t.Errorf("non-ASCII file name: got %q", got)
+	}
+
+	for _, path := range []string{
+		"/_matrix/media/r0/download/other.org/abcdefgh",
+		"/_matrix/media/r0/download/example.org/unknown0",
+		"/_matrix/media/r0/download/example.org/nofile00",
+		"/_matrix/media/r0/download/example.org/../../etc",
+	} {
+		if w := get(path, nil); w.Code != 299 {
+			t.Errorf("%s: want fallback got %d", path, w.Code)
+		}
+	}
+}
+
+// testPNG returns a width by height PNG.
+func testPNG(t *testing.T, width, height int) string {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestContentDisposition(t *testing.T) {
+	for name, want := range map[string]string{
+		"cat.png":         `inline; filename="cat.png"`,
+		"hello world.txt": `inline; filename="hello world.txt"`,
+		`say "hi" \o/`:    `inline; filename="say \"hi\" \\o/"`,
+		"héllo wörld.txt": "inline; filename*=utf-8''h%C3%A9llo%20w%C3%B6rld.txt",
+		"tab\there":       "inline; filename*=utf-8''tab%09here",
+	} {
+		if got := contentDisposition("inline", name); got != want {
+			t.Errorf("contentDisposition(%q): want %s got %s", name, want, got)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	s, cleanup := testStore(t, map[string]*localMedia{
+		"picture0": {mediaID: "picture0", mediaType: "image/png"},
+		"document": {mediaID: "document", mediaType: "application/pdf"},
+	}, map[string]string{
+		"picture0": testPNG(t, 400, 200),
+		"document": "%PDF",
+	})
+	defer cleanup()
+	cache, err := NewThumbnailCache(filepath.Join(s.path, "thumbnails"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := ParseThumbnailSizes(DefaultThumbnailSizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := ThumbnailOptions{Sizes: sizes, MaxPixels: 1 << 20, MaxConcurrent: 1}
+	h := NewThumbnailHandler(s, cache, options, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(299)
+	}))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// Requests are served with the closest larger configured size.
+	for query, want := range map[string]image.Point{
+		"width=96&height=96&method=crop":    {96, 96},
+		"width=20&height=20&method=crop":    {32, 32},
+		"width=100&height=100&method=scale": {320, 160},
+		"width=800&height=600&method=scale": {400, 200},
+		"width=50&height=100":               {320, 160},
+	} {
+		w := get("/_matrix/media/r0/thumbnail/example.org/picture0?" + query)
+		if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("%s: want a PNG got %d %s", query, w.Code, w.Header().Get("Content-Type"))
+			continue
+		}
+		config, err := png.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (image.Point{config.Width, config.Height}); got != want {
+			t.Errorf("%s: want %v got %v", query, want, got)
+		}
+	}
+
+	// Thumbnails are served from the cache once they have been made.
+	os.Remove(s.localMediaPath("picture0"))
+	if w := get("/_matrix/media/r0/thumbnail/example.org/picture0?width=90&height=90&method=crop"); w.Code != 200 {
+		t.Errorf("cached: want 200 got %d", w.Code)
+	}
+
+	for _, path := range []string{
+		"/_matrix/media/r0/thumbnail/example.org/document?width=100&height=100",
+		"/_matrix/media/r0/thumbnail/other.org/picture0?width=100&height=100",
+		"/_matrix/media/r0/thumbnail/example.org/picture0?width=100&height=100&method=stretch",
+		"/_matrix/media/r0/thumbnail/example.org/picture0?width=100000&height=100",
+		"/_matrix/media/r0/thumbnail/example.org/picture0?width=100&height=100&method=crop",
+		"/_matrix/media/r0/thumbnail/example.org/picture0?width=600&height=400",
+	} {
+		if w := get(path); w.Code != 299 {
+			t.Errorf("%s: want fallback got %d", path, w.Code)
+		}
+	}
+}
+
+func TestParseThumbnailSizes(t *testing.T) {
+	sizes, err := ParseThumbnailSizes("32x32-crop, 640x480-scale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ThumbnailSize{{32, 32, "crop"}, {640, 480, "scale"}}
+	if len(sizes) != len(want) || sizes[0] != want[0] || sizes[1] != want[1] {
+		t.Errorf("want %v got %v", want, sizes)
+	}
+	for _, list := range []string{"32x32", "32-crop", "axb-crop", "0x32-crop", "5000x32-scale", "32x32-stretch"} {
+		if _, err := ParseThumbnailSizes(list); err == nil {
+			t.Errorf("%q: want error", list)
+		}
+	}
+}
+
+func TestResizeFastPaths(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 64, 48), image.YCbCrSubsampleRatio420)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			rgba.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(x + y), 255})
+			ycbcr.Y[ycbcr.YOffset(x, y)] = uint8(x*3 + y)
+			ycbcr.Cb[ycbcr.COffset(x, y)] = uint8(x * 4)
+			ycbcr.Cr[ycbcr.COffset(x, y)] = uint8(y * 5)
+		}
+	}
+	for _, src := range []image.Image{rgba, ycbcr} {
+		// Hiding the type makes resize read the pixels with At.
+		want := resize(struct{ image.Image }{src}, src.Bounds(), 20, 15)
+		if got := resize(src, src.Bounds(), 20, 15); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%T: want the same pixels as the generic path", src)
+		}
+	}
+}
+
+func TestCropExtremeAspectRatio(t *testing.T) {
+	for _, size := range []image.Point{{1, 1000000}, {1000000, 1}, {3, 200000}} {
+		src := image.NewGray(image.Rect(0, 0, size.X, size.Y))
+		for i := range src.Pix {
+			src.Pix[i] = uint8(i)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, src); err != nil {
+			t.Fatal(err)
+		}
+		// Only the middle of the image is resized, rather than scaling
+		// the whole of it up to cover the thumbnail first.
+		data, err := makeThumbnail(bytes.NewReader(buf.Bytes()), 96, 96, "crop", "image/png", 10000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 96 || config.Height != 96 {
+			t.Errorf("%v: want a 96x96 thumbnail got %dx%d", size, config.Width, config.Height)
+		}
+	}
+}
+
+func TestThumbnailCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewThumbnailCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := c.Put("abcdefgh", name, []byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Bytes() != 8 {
+		t.Errorf("want 8 bytes got %d", c.Bytes())
+	}
+	if f, _ := c.Open("abcdefgh", "a"); f != nil {
+		t.Error("want the least recently used thumbnail evicted")
+	}
+	if _, err := os.Stat(c.path("abcdefgh", "a")); !os.IsNotExist(err) {
+		t.Errorf("want the evicted file removed got %v", err)
+	}
+	c.Put("abcdefgh", "c", []byte("12"))
+	if c.Bytes() != 6 {
+		t.Errorf("after replacing: want 6 bytes got %d", c.Bytes())
+	}
+
+	// A new cache picks up the thumbnails already on disk.
+	c, err = NewThumbnailCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Open("abcdefgh", "c")
+	if err != nil || f == nil {
+		t.Fatalf("want c reopened got %v", err)
+	}
+	f.Close()
+	if c.Bytes() != 6 {
+		t.Errorf("reopened: want 6 bytes got %d", c.Bytes())
+	}
+}
+
+// TestQueryLocalMedia checks the query against the postgres database in
+// $DENDRON_TEST_POSTGRES.
+func TestQueryLocalMedia(t *testing.T) {
+	dsn := os.Getenv("DENDRON_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("DENDRON_TEST_POSTGRES isn't set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`CREATE TEMP TABLE local_media_repository (media_id TEXT, media_type TEXT, media_length INTEGER, created_ts BIGINT, upload_name TEXT, user_id TEXT, quarantined_by TEXT, url_cache TEXT, last_access_ts BIGINT, UNIQUE(media_id))`,
+		`INSERT INTO local_media_repository (media_id, media_type, media_length, created_ts, upload_name) VALUES ('abcdefgh', 'image/png', 42, 1000, 'cat.png')`,
+		`INSERT INTO local_media_repository (media_id, media_type, media_length, created_ts, quarantined_by) VALUES ('quarantd', 'image/png', 42, 1000, '@admin:example.org')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewStore(db, "", "example.org")
+	m, err := s.localMedia("abcdefgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || m.mediaType != "image/png" || m.length != 42 || m.uploadName != "cat.png" || !m.created.Equal(time.Unix(1, 0)) {
+		t.Errorf("unexpected media %+v", m)
+	}
+	for _, mediaID := range []string{"quarantd", "unknown0"} {
+		if m, err := s.localMedia(mediaID); m != nil || err != nil {
+			t.Errorf("%s: want nothing got %+v %v", mediaID, m, err)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := NewPolicy(DefaultContentSecurityPolicy, DefaultInlineTypes)
+	var contentType, disposition string
+	var status int
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		w.WriteHeader(status)
+	}))
+
+	for _, test := range []struct {
+		path, contentType, disposition string
+		status                         int
+		want                           string
+	}{
+		{"/_matrix/media/r0/download/a/b", "image/png", "inline; filename=cat.png", 200, "inline; filename=cat.png"},
+		{"/_matrix/media/r0/download/a/b", "text/html; charset=UTF-8", "inline; filename=evil.html", 200, "attachment; filename=evil.html"},
+		{"/_matrix/media/r0/download/a/b/evil.svg", "image/svg+xml", "", 200, "attachment"},
+		{"/_matrix/media/r0/download/a/b", "Image/PNG", "", 206, ""},
+		{"/_matrix/media/r0/download/a/b", "application/json", "", 404, ""},
+		{"/_matrix/media/r0/thumbnail/a/b", "image/svg+xml", "", 200, ""},
+	} {
+		contentType, disposition, status = test.contentType, test.disposition, test.status
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if got := w.Header().Get("Content-Disposition"); got != test.want {
+			t.Errorf("%s %s: want Content-Disposition %q got %q", test.path, test.contentType, test.want, got)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Security-Policy") != DefaultContentSecurityPolicy {
+			t.Errorf("%s: missing security headers %v", test.path, w.Header())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/_matrix/client/r0/sync", nil))
+	if w.Header().Get("X-Content-Type-Options") != "" {
+		t.Error("want other APIs left alone")
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	for path, want := range map[string]string{
+		"/_matrix/media/r0/download/example.org/abcdefgh":         "example.org/abcdefgh",
+		"/_matrix/media/v3/download/example.org/abcdefgh/cat.png": "example.org/abcdefgh",
+		"/_matrix/media/r0/thumbnail/other.org/abcdefgh":          "other.org/abcdefgh",
+		"/_matrix/media/r0/upload":                                "",
+		"/_matrix/media/v3/upload/example.org/abcdefgh":           "",
+		"/_matrix/media/r0/preview_url":                           "",
+	} {
+		if got := ShardKey(path); got != want {
+			t.Errorf("%s: want %q got %q", path, want, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package media
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultContentSecurityPolicy stops media from running scripts or loading
+// anything if a browser renders it.
+const DefaultContentSecurityPolicy = "sandbox; default-src 'none'; script-src 'none'; style-src 'unsafe-inline'; media-src 'self'; object-src 'self'"
+
+// DefaultInlineTypes are the media types that are safe for a browser to
+// show inline, which notably don't include HTML or SVG.
+var DefaultInlineTypes = []string{
+	"text/plain", "text/csv",
+	"image/jpeg", "image/gif", "image/png", "image/apng", "image/webp", "image/avif",
+	"video/mp4", "video/webm", "video/ogg", "video/quicktime",
+	"audio/mp4", "audio/webm", "audio/aac", "audio/mpeg", "audio/ogg", "audio/wav", "audio/wave", "audio/x-wav", "audio/flac", "audio/x-flac",
+}
+
+// A Policy sets the headers on media responses so that uploaded files can't
+// be used to attack the homeserver's origin.
+type Policy struct {
+	csp         string
+	inlineTypes map[string]bool
+}
+
+// NewPolicy creates a Policy that sets the Content-Security-Policy csp on all
+// media responses, and makes downloads of anything but inlineTypes
+// attachments.
+func NewPolicy(csp string, inlineTypes []string) *Policy {
+	p := &Policy{csp: csp, inlineTypes: make(map[string]bool)}
+	for _, t := range inlineTypes {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			p.inlineTypes[t] = true
+		}
+	}
+	return p
+}
+
+// Handler wraps next so that responses to /_matrix/media/ requests follow
+// the policy, whether they come from a media repository or dendron itself.
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/_matrix/media/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(&policyWriter{
+			ResponseWriter: w,
+			policy:         p,
+			download:       downloadPath.MatchString(req.URL.Path),
+		}, req)
+	})
+}
+
+// apply sets the policy's headers on a response.
+func (p *Policy) apply(header http.Header, download bool) {
+	if p.csp != "" {
+		header.Set("Content-Security-Policy", p.csp)
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	if !download {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && p.inlineTypes[mediaType] {
+		return
+	}
+	disposition := header.Get("Content-Disposition")
+	if i := strings.IndexByte(disposition, ';'); i >= 0 {
+		header.Set("Content-Disposition", "attachment"+disposition[i:])
+	} else {
+		header.Set("Content-Disposition", "attachment")
+	}
+}
+
+// policyWriter applies a policy to the headers of a response just before
+// they are written.
+type policyWriter struct {
+	http.ResponseWriter
+	policy      *Policy
+	download    bool
+	wroteHeader bool
+}
+
+func (w *policyWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		// Errors from the media repository are JSON and don't need to be
+		// downloaded.
+		w.policy.apply(w.Header(), w.download && status >= 200 && status < 300)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *policyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (w *policyWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *policyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
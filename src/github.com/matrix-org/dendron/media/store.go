@@ -0,0 +1,111 @@
+// Package media serves synapse's local media directly from its media store,
+// falling back to the media repository for anything it can't handle.
+package media
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// validMediaID matches the media IDs synapse generates, which are safe to use
+// in file paths.
+var validMediaID = regexp.MustCompile(`^[A-Za-z0-9_=-]{5,}$`)
+
+// localMedia is synapse's metadata about an uploaded file.
+type localMedia struct {
+	mediaID    string
+	mediaType  string
+	length     int64
+	uploadName string
+	created    time.Time
+}
+
+// A Store reads synapse's local media.
+type Store struct {
+	db         *sql.DB
+	path       string
+	serverName string
+
+	// lookup queries the metadata for a valid media ID, and is replaced in
+	// tests.
+	lookup func(mediaID string) (*localMedia, error)
+}
+
+// NewStore creates a Store for the server serverName that reads metadata from
+// synapse's database db and files from its media_store_path.
+func NewStore(db *sql.DB, mediaStorePath, serverName string) *Store {
+	s := &Store{db: db, path: mediaStorePath, serverName: serverName}
+	s.lookup = s.queryLocalMedia
+	return s
+}
+
+// IsLocal returns whether media from serverName was uploaded to this server.
+func (s *Store) IsLocal(serverName string) bool {
+	return serverName == s.serverName
+}
+
+// localMedia returns the metadata for mediaID, or nil if there isn't any
+// media it can be served for. Media that is quarantined or was downloaded for
+// a URL preview is left to synapse.
+func (s *Store) localMedia(mediaID string) (*localMedia, error) {
+	if !validMediaID.MatchString(mediaID) {
+		return nil, nil
+	}
+	return s.lookup(mediaID)
+}
+
+func (s *Store) queryLocalMedia(mediaID string) (*localMedia, error) {
+	m := localMedia{mediaID: mediaID}
+	var mediaType, uploadName, quarantinedBy, urlCache sql.NullString
+	var length, createdTs sql.NullInt64
+	err := s.db.QueryRow(
+		"SELECT media_type, media_length, upload_name, created_ts, quarantined_by, url_cache"+
+			" FROM local_media_repository WHERE media_id = $1",
+		mediaID,
+	).Scan(&mediaType, &length, &uploadName, &createdTs, &quarantinedBy, &urlCache)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if quarantinedBy.Valid || urlCache.Valid {
+		return nil, nil
+	}
+	m.mediaType = mediaType.String
+	m.length = length.Int64
+	m.uploadName = uploadName.String
+	m.created = time.Unix(0, createdTs.Int64*int64(time.Millisecond))
+	return &m, nil
+}
+
+// localMediaPath returns the path synapse stores the file for mediaID at.
+func (s *Store) localMediaPath(mediaID string) string {
+	return filepath.Join(s.path, "local_content", mediaID[0:2], mediaID[2:4], mediaID[4:])
+}
+
+// open opens the file for m, returning nil if it isn't in the media store.
+func (s *Store) open(m *localMedia) (*os.File, error) {
+	f, err := os.Open(s.localMediaPath(m.mediaID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// shardedPath matches the media endpoints for a particular piece of media.
+var shardedPath = regexp.MustCompile(`^/_matrix/media/[^/]+/(download|thumbnail)/([^/]+)/([^/]+)`)
+
+// ShardKey returns the key to shard a request for path between media
+// repositories by, "{serverName}/{mediaId}", or "" if it isn't for a
+// particular piece of media and can go to any of them.
+func ShardKey(path string) string {
+	match := shardedPath.FindStringSubmatch(path)
+	if match == nil {
+		return ""
+	}
+	return match[2] + "/" + match[3]
+}
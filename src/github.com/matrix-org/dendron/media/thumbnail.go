@@ -0,0 +1,274 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// thumbnailPath matches /_matrix/media/{version}/thumbnail/{serverName}/{mediaId}.
+var thumbnailPath = regexp.MustCompile(`^/_matrix/media/[^/]+/thumbnail/([^/]+)/([^/]+)$`)
+
+// maxThumbnailSize is the largest width or height of thumbnail made natively.
+const maxThumbnailSize = 2048
+
+// DefaultThumbnailSizes are the sizes that synapse makes thumbnails in by
+// default.
+const DefaultThumbnailSizes = "32x32-crop,96x96-crop,320x240-scale,640x480-scale,800x600-scale"
+
+// A ThumbnailSize is one of the sizes that thumbnails are made in.
+type ThumbnailSize struct {
+	Width  int
+	Height int
+	// Method is either "crop" or "scale".
+	Method string
+}
+
+// ParseThumbnailSizes parses a comma separated list of thumbnail sizes in the
+// form {width}x{height}-{method}, e.g. "96x96-crop".
+func ParseThumbnailSizes(list string) ([]ThumbnailSize, error) {
+	var sizes []ThumbnailSize
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var size ThumbnailSize
+		dims, method, ok := strings.Cut(entry, "-")
+		width, height, ok2 := strings.Cut(dims, "x")
+		var err error
+		if size.Width, err = strconv.Atoi(width); err != nil || !ok || !ok2 {
+			return nil, fmt.Errorf("invalid thumbnail size %q", entry)
+		}
+		if size.Height, err = strconv.Atoi(height); err != nil {
+			return nil, fmt.Errorf("invalid thumbnail size %q", entry)
+		}
+		if size.Width < 1 || size.Width > maxThumbnailSize || size.Height < 1 || size.Height > maxThumbnailSize {
+			return nil, fmt.Errorf("thumbnail size %q must be between 1 and %d pixels", entry, maxThumbnailSize)
+		}
+		if method != "crop" && method != "scale" {
+			return nil, fmt.Errorf("thumbnail size %q must use \"crop\" or \"scale\"", entry)
+		}
+		size.Method = method
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// selectSize returns the size to serve a request for a thumbnail of width by
+// height made with method: the smallest size made with method that is at
+// least as large as requested. It returns false if there isn't one, in which
+// case the media repository is left to deal with the request.
+func selectSize(sizes []ThumbnailSize, width, height int, method string) (ThumbnailSize, bool) {
+	var best ThumbnailSize
+	found := false
+	for _, size := range sizes {
+		if size.Method != method || size.Width < width || size.Height < height {
+			continue
+		}
+		if !found || size.Width*size.Height < best.Width*best.Height {
+			best, found = size, true
+		}
+	}
+	return best, found
+}
+
+// ThumbnailOptions configures a ThumbnailHandler.
+type ThumbnailOptions struct {
+	// Sizes are the sizes thumbnails are made in. Requests for other sizes
+	// are served with the closest larger one.
+	Sizes []ThumbnailSize
+	// MaxPixels is the largest image in pixels to make thumbnails of.
+	MaxPixels int
+	// MaxConcurrent is how many thumbnails may be made at once, to bound
+	// the CPU and memory used. Zero means no limit.
+	MaxConcurrent int
+}
+
+var thumbnailCacheBytesDesc = prometheus.NewDesc(
+	"dendron_media_thumbnail_cache_bytes",
+	"Size of the thumbnails in the thumbnail cache",
+	nil, nil,
+)
+
+// A thumbnailCall is a thumbnail being made, which requests for the same
+// thumbnail wait for rather than making it again.
+type thumbnailCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// A ThumbnailHandler serves thumbnails of local media, making them from the
+// files in the media store and caching them on disk. Remote media, and media
+// it can't make thumbnails of, are passed to a fallback.
+// It implements prometheus.Collector to export how thumbnails were served.
+type ThumbnailHandler struct {
+	store     *Store
+	cache     *ThumbnailCache
+	fallback  http.Handler
+	sizes     []ThumbnailSize
+	maxPixels int
+	// semaphore has a slot for each thumbnail that may be made at once,
+	// or is nil if there is no limit.
+	semaphore chan struct{}
+
+	mutex    sync.Mutex
+	inflight map[string]*thumbnailCall
+
+	thumbnails *prometheus.CounterVec
+}
+
+// NewThumbnailHandler creates a ThumbnailHandler that makes thumbnails of
+// images from store as configured by options, caches them in cache, and
+// passes other requests to fallback.
+func NewThumbnailHandler(store *Store, cache *ThumbnailCache, options ThumbnailOptions, fallback http.Handler) *ThumbnailHandler {
+	var semaphore chan struct{}
+	if options.MaxConcurrent > 0 {
+		semaphore = make(chan struct{}, options.MaxConcurrent)
+	}
+	return &ThumbnailHandler{
+		store:     store,
+		cache:     cache,
+		fallback:  fallback,
+		sizes:     options.Sizes,
+		maxPixels: options.MaxPixels,
+		semaphore: semaphore,
+		inflight:  make(map[string]*thumbnailCall),
+		thumbnails: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_media_thumbnails_total",
+				Help: "Number of thumbnail requests by whether they were served from the cache, generated, or passed to the media repository",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (h *ThumbnailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.serve(w, req) {
+		h.thumbnails.WithLabelValues("fallback").Inc()
+		h.fallback.ServeHTTP(w, req)
+	}
+}
+
+// serve serves req natively, returning false if it needs to fall back.
+func (h *ThumbnailHandler) serve(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	match := thumbnailPath.FindStringSubmatch(req.URL.Path)
+	if match == nil || !h.store.IsLocal(match[1]) {
+		return false
+	}
+	mediaID := match[2]
+	query := req.URL.Query()
+	width, err := strconv.Atoi(query.Get("width"))
+	if err != nil || width < 1 {
+		return false
+	}
+	height, err := strconv.Atoi(query.Get("height"))
+	if err != nil || height < 1 {
+		return false
+	}
+	method := query.Get("method")
+	if method == "" {
+		method = "scale"
+	}
+	// Only the configured sizes are made so that a client can't fill the
+	// cache with thumbnails of every size.
+	size, ok := selectSize(h.sizes, width, height, method)
+	if !ok {
+		return false
+	}
+	width, height = size.Width, size.Height
+
+	m, err := h.store.localMedia(mediaID)
+	if err != nil || m == nil || !thumbnailTypes[m.mediaType] {
+		logError(mediaID, err)
+		return false
+	}
+	outputType := thumbnailType(m.mediaType)
+	name := fmt.Sprintf("%s-%dx%d-%s.%s", mediaID, width, height, method, outputType[len("image/"):])
+
+	cached, err := h.cache.Open(mediaID, name)
+	if err != nil {
+		logError(mediaID, err)
+	}
+	if cached != nil {
+		defer cached.Close()
+		setHeaders(w, outputType, "")
+		h.thumbnails.WithLabelValues("cached").Inc()
+		http.ServeContent(w, req, "", m.created, cached)
+		return true
+	}
+
+	data, err := h.generate(m, name, width, height, method, outputType)
+	if err != nil || data == nil {
+		logError(mediaID, err)
+		return false
+	}
+	setHeaders(w, outputType, "")
+	h.thumbnails.WithLabelValues("generated").Inc()
+	http.ServeContent(w, req, "", m.created, bytes.NewReader(data))
+	return true
+}
+
+// generate makes the thumbnail called name of m and caches it, waiting for
+// another request that is already making it if there is one. It returns nil
+// if the file isn't in the media store.
+func (h *ThumbnailHandler) generate(m *localMedia, name string, width, height int, method, outputType string) ([]byte, error) {
+	h.mutex.Lock()
+	if call, ok := h.inflight[name]; ok {
+		h.mutex.Unlock()
+		<-call.done
+		return call.data, call.err
+	}
+	call := &thumbnailCall{done: make(chan struct{})}
+	h.inflight[name] = call
+	h.mutex.Unlock()
+
+	defer func() {
+		h.mutex.Lock()
+		delete(h.inflight, name)
+		h.mutex.Unlock()
+		close(call.done)
+	}()
+
+	f, err := h.store.open(m)
+	if err != nil || f == nil {
+		call.err = err
+		return nil, err
+	}
+	defer f.Close()
+	if h.semaphore != nil {
+		h.semaphore <- struct{}{}
+		defer func() { <-h.semaphore }()
+	}
+	if call.data, call.err = makeThumbnail(f, width, height, method, outputType, h.maxPixels); call.err != nil {
+		return nil, call.err
+	}
+	if err := h.cache.Put(m.mediaID, name, call.data); err != nil {
+		logError(m.mediaID, err)
+	}
+	return call.data, nil
+}
+
+// Describe implements prometheus.Collector
+func (h *ThumbnailHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.thumbnails.Describe(ch)
+	ch <- thumbnailCacheBytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (h *ThumbnailHandler) Collect(ch chan<- prometheus.Metric) {
+	h.thumbnails.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(thumbnailCacheBytesDesc, prometheus.GaugeValue, float64(h.cache.Bytes()))
+}
@@ -0,0 +1,157 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// thumbnailTypes are the media types thumbnails can be made from natively.
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// thumbnailType returns the type of the thumbnails made from mediaType. Like
+// synapse, JPEGs make JPEG thumbnails and everything else makes PNGs.
+func thumbnailType(mediaType string) string {
+	if mediaType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// makeThumbnail decodes the image in r and returns a thumbnail of it of at
+// most width by height, in outputType. If method is "crop" it is scaled to
+// cover width by height and the middle cut out. If it is "scale" it is scaled
+// to fit inside width by height, but never made larger than the original.
+// Images of more than maxPixels are refused to limit the memory used.
+func makeThumbnail(r io.ReadSeeker, width, height int, method, outputType string, maxPixels int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("media: image has no pixels")
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("media: image of %dx%d is too large to thumbnail", config.Width, config.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+
+	var thumbnail image.Image
+	switch method {
+	case "crop":
+		// The middle of the source with the same aspect ratio as the
+		// thumbnail is cut out first, so that only it is resized.
+		crop := src.Bounds()
+		if width*srcHeight > height*srcWidth {
+			cropHeight := max(srcWidth*height/width, 1)
+			crop.Min.Y += (srcHeight - cropHeight) / 2
+			crop.Max.Y = crop.Min.Y + cropHeight
+		} else {
+			cropWidth := max(srcHeight*width/height, 1)
+			crop.Min.X += (srcWidth - cropWidth) / 2
+			crop.Max.X = crop.Min.X + cropWidth
+		}
+		thumbnail = resize(src, crop, width, height)
+	case "scale":
+		if width*srcHeight < height*srcWidth {
+			height = width * srcHeight / srcWidth
+		} else {
+			width = height * srcWidth / srcHeight
+		}
+		thumbnail = resize(src, src.Bounds(), min(width, srcWidth), min(height, srcHeight))
+	default:
+		return nil, fmt.Errorf("media: unknown thumbnail method %q", method)
+	}
+
+	var buf bytes.Buffer
+	if outputType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&buf, thumbnail)
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales the part of src within bounds to width by height, averaging
+// the pixels that each pixel of the result covers.
+func resize(src image.Image, bounds image.Rectangle, width, height int) *image.RGBA {
+	width, height = max(width, 1), max(height, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if bounds.Dx() == width && bounds.Dy() == height {
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+	at := pixelReader(src)
+	for y := 0; y < height; y++ {
+		y0, y1 := span(y, height, bounds.Min.Y, bounds.Dy())
+		for x := 0; x < width; x++ {
+			x0, x1 := span(x, width, bounds.Min.X, bounds.Dx())
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, sa := at(sx, sy)
+					r, g, b, a, n = r+uint64(sr), g+uint64(sg), b+uint64(sb), a+uint64(sa), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// pixelReader returns a function that reads the pixels of src the same way as
+// src.At(x, y).RGBA(). JPEGs and PNGs usually decode to *image.YCbCr and
+// *image.RGBA, which are read directly rather than allocating a color.Color
+// for every pixel.
+func pixelReader(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch src := src.(type) {
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := src.PixOffset(x, y)
+			p := src.Pix[i : i+4 : i+4]
+			return uint32(p[0]) * 0x101, uint32(p[1]) * 0x101, uint32(p[2]) * 0x101, uint32(p[3]) * 0x101
+		}
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			return color.YCbCr{
+				Y:  src.Y[src.YOffset(x, y)],
+				Cb: src.Cb[src.COffset(x, y)],
+				Cr: src.Cr[src.COffset(x, y)],
+			}.RGBA()
+		}
+	default:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			return src.At(x, y).RGBA()
+		}
+	}
+}
+
+// span returns the range of source pixels that pixel i of n covers, when the
+// source starts at offset and is size pixels long.
+func span(i, n, offset, size int) (int, int) {
+	start := offset + i*size/n
+	end := offset + (i+1)*size/n
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
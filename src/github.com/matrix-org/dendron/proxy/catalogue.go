@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The endpoints in paths.go are generated from the client-server API specs in
+// matrix-doc, or are read from them at startup by LoadEndpointSpecs. The
+// endpoints below are implemented by synapse but aren't
+// covered by those specs so they are maintained by hand.
+
+// clientEndpoints are client-server endpoints missing from the specs.
+var clientEndpoints = []string{
+	`/_matrix/client/r0/account/whoami`,
+	`/_matrix/client/r0/delete_devices`,
+	`/_matrix/client/r0/devices`,
+	`/_matrix/client/r0/devices/{deviceId}`,
+	`/_matrix/client/r0/directory/list/room/{roomId}`,
+	`/_matrix/client/r0/directory/room/{roomAlias}`,
+	`/_matrix/client/r0/joined_rooms`,
+	`/_matrix/client/r0/keys/changes`,
+	`/_matrix/client/r0/keys/claim`,
+	`/_matrix/client/r0/keys/query`,
+	`/_matrix/client/r0/keys/upload`,
+	`/_matrix/client/r0/keys/upload/{deviceId}`,
+	`/_matrix/client/r0/logout/all`,
+	`/_matrix/client/r0/register/available`,
+	`/_matrix/client/r0/rooms/{roomId}/joined_members`,
+	`/_matrix/client/r0/rooms/{roomId}/report/{eventId}`,
+	`/_matrix/client/r0/thirdparty/location`,
+	`/_matrix/client/r0/thirdparty/location/{protocol}`,
+	`/_matrix/client/r0/thirdparty/protocol/{protocol}`,
+	`/_matrix/client/r0/thirdparty/protocols`,
+	`/_matrix/client/r0/thirdparty/user`,
+	`/_matrix/client/r0/thirdparty/user/{protocol}`,
+	`/_matrix/client/r0/user/{userId}/openid/request_token`,
+	`/_matrix/client/r0/user_directory/search`,
+}
+
+// mediaEndpoints are media repository endpoints missing from the specs.
+var mediaEndpoints = []string{
+	`/_matrix/media/r0/config`,
+	`/_matrix/media/r0/preview_url`,
+	`/_matrix/media/v1/download/{serverName}/{mediaId}`,
+	`/_matrix/media/v1/download/{serverName}/{mediaId}/{fileName}`,
+	`/_matrix/media/v1/preview_url`,
+	`/_matrix/media/v1/thumbnail/{serverName}/{mediaId}`,
+	`/_matrix/media/v1/upload`,
+}
+
+// federationEndpoints are the server-server API endpoints.
+var federationEndpoints = []string{
+	`/_matrix/federation/v1/3pid/onbind`,
+	`/_matrix/federation/v1/backfill/{roomId}`,
+	`/_matrix/federation/v1/event/{eventId}`,
+	`/_matrix/federation/v1/event_auth/{roomId}/{eventId}`,
+	`/_matrix/federation/v1/exchange_third_party_invite/{roomId}`,
+	`/_matrix/federation/v1/get_missing_events/{roomId}`,
+	`/_matrix/federation/v1/invite/{roomId}/{eventId}`,
+	`/_matrix/federation/v1/make_join/{roomId}/{userId}`,
+	`/_matrix/federation/v1/make_leave/{roomId}/{userId}`,
+	`/_matrix/federation/v1/openid/userinfo`,
+	`/_matrix/federation/v1/publicRooms`,
+	`/_matrix/federation/v1/query/{queryType}`,
+	`/_matrix/federation/v1/query_auth/{roomId}/{eventId}`,
+	`/_matrix/federation/v1/send/{txnId}`,
+	`/_matrix/federation/v1/send/{txnId}/`,
+	`/_matrix/federation/v1/send_join/{roomId}/{eventId}`,
+	`/_matrix/federation/v1/send_leave/{roomId}/{eventId}`,
+	`/_matrix/federation/v1/state/{roomId}`,
+	`/_matrix/federation/v1/state/{roomId}/`,
+	`/_matrix/federation/v1/state_ids/{roomId}`,
+	`/_matrix/federation/v1/state_ids/{roomId}/`,
+	`/_matrix/federation/v1/user/devices/{userId}`,
+	`/_matrix/federation/v1/user/keys/claim`,
+	`/_matrix/federation/v1/user/keys/query`,
+	`/_matrix/federation/v1/version`,
+}
+
+// keyEndpoints are the server key API endpoints.
+var keyEndpoints = []string{
+	`/_matrix/key/v2/query`,
+	`/_matrix/key/v2/query/{serverName}/{keyId}`,
+	`/_matrix/key/v2/server`,
+	`/_matrix/key/v2/server/`,
+	`/_matrix/key/v2/server/{keyId}`,
+}
+
+// adminEndpoints are synapse's administration API endpoints.
+var adminEndpoints = []string{
+	`/_matrix/client/r0/admin/deactivate/{userId}`,
+	`/_matrix/client/r0/admin/purge_history/{roomId}`,
+	`/_matrix/client/r0/admin/purge_history/{roomId}/{eventId}`,
+	`/_matrix/client/r0/admin/purge_media_cache`,
+	`/_matrix/client/r0/admin/quarantine_media/{roomId}`,
+	`/_matrix/client/r0/admin/reset_password/{userId}`,
+	`/_matrix/client/r0/admin/shutdown_room/{roomId}`,
+	`/_synapse/admin/v1/deactivate/{userId}`,
+	`/_synapse/admin/v1/purge_history/{roomId}`,
+	`/_synapse/admin/v1/purge_history/{roomId}/{eventId}`,
+	`/_synapse/admin/v1/purge_history_status/{purgeId}`,
+	`/_synapse/admin/v1/purge_media_cache`,
+	`/_synapse/admin/v1/quarantine_media/{roomId}`,
+	`/_synapse/admin/v1/register`,
+	`/_synapse/admin/v1/reset_password/{userId}`,
+	`/_synapse/admin/v1/room/{roomId}/media`,
+	`/_synapse/admin/v1/server_version`,
+	`/_synapse/admin/v1/shutdown_room/{roomId}`,
+	`/_synapse/admin/v1/whois/{userId}`,
+	`/_synapse/admin/v2/users`,
+	`/_synapse/admin/v2/users/{userId}`,
+}
+
+var (
+	// catalogueMutex protects specTemplates and addedTemplates.
+	catalogueMutex sync.Mutex
+	// specTemplates are the endpoints from the matrix-doc API specs.
+	specTemplates = endpointTemplates
+	// addedTemplates are the endpoints added by AddEndpoints.
+	addedTemplates []string
+)
+
+const (
+	clientR0Prefix       = "/_matrix/client/r0/"
+	clientUnstablePrefix = "/_matrix/client/unstable/"
+)
+
+// knownEndpoints returns the templates of every built in endpoint.
+// Synapse serves each r0 client-server endpoint under the unstable prefix as
+// well so those are included too.
+func knownEndpoints() []string {
+	var templates []string
+	for _, group := range [][]string{
+		specTemplates, clientEndpoints, mediaEndpoints,
+		federationEndpoints, keyEndpoints, adminEndpoints,
+	} {
+		templates = append(templates, group...)
+	}
+	for _, template := range templates {
+		if strings.HasPrefix(template, clientR0Prefix) {
+			templates = append(templates, clientUnstablePrefix+template[len(clientR0Prefix):])
+		}
+	}
+	return templates
+}
+
+// AddEndpoints adds path templates to the endpoints used to label metrics.
+// Path parameters are written as {param}. The templates take effect for
+// requests proxied after the call. If a path matches more than one template
+// then a template without parameters is used over one with parameters, so an
+// added constant template can split a built in endpoint. Otherwise the built
+// in template is used.
+func AddEndpoints(templates []string) error {
+	for _, template := range templates {
+		if !strings.HasPrefix(template, "/") {
+			return fmt.Errorf("endpoint template %q must start with \"/\"", template)
+		}
+	}
+	catalogueMutex.Lock()
+	defer catalogueMutex.Unlock()
+	addedTemplates = append(addedTemplates, templates...)
+	rebuildEndpoints()
+	return nil
+}
+
+// rebuildEndpoints rebuilds the trie used to classify request paths from the
+// catalogue. The catalogueMutex must be held when calling it.
+func rebuildEndpoints() {
+	setEndpoints(newEndpointTrie(append(knownEndpoints(), addedTemplates...)))
+}
+
+// apiFor returns which Matrix API a request path belongs to: one of
+// "client", "federation", "media", "key", "admin" or "other".
+func apiFor(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/_matrix/client/"):
+		// Synapse's older admin APIs live alongside the client-server API,
+		// e.g. /_matrix/client/r0/admin/whois/{userId}.
+		rest := path[len("/_matrix/client/"):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 && strings.HasPrefix(rest[i+1:], "admin/") {
+			return "admin"
+		}
+		return "client"
+	case strings.HasPrefix(path, "/_matrix/federation/"):
+		return "federation"
+	case strings.HasPrefix(path, "/_matrix/media/"):
+		return "media"
+	case strings.HasPrefix(path, "/_matrix/key/"):
+		return "key"
+	case strings.HasPrefix(path, "/_synapse/admin/"):
+		return "admin"
+	default:
+		return "other"
+	}
+}
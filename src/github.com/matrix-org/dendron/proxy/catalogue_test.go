@@ -0,0 +1,66 @@
+package proxy
+
+import "testing"
+
+func TestAPIFor(t *testing.T) {
+	for path, want := range map[string]string{
+		"/_matrix/client/r0/sync":                           "client",
+		"/_matrix/client/unstable/keys/upload":              "client",
+		"/_matrix/client/r0/admin/whois/@alice:example.com": "admin",
+		"/_synapse/admin/v1/purge_media_cache":              "admin",
+		"/_matrix/federation/v1/send/1234":                  "federation",
+		"/_matrix/media/r0/upload":                          "media",
+		"/_matrix/key/v2/server/ed25519:a":                  "key",
+		"/_dendron/metrics":                                 "other",
+	} {
+		if got := apiFor(path); got != want {
+			t.Errorf("apiFor(%q): want %q got %q", path, want, got)
+		}
+	}
+}
+
+func TestCatalogue(t *testing.T) {
+	for path, want := range map[string]string{
+		"/_matrix/federation/v1/send/1234":             "/_matrix/federation/v1/send/_",
+		"/_matrix/key/v2/query/example.com/ed25519:a":  "/_matrix/key/v2/query/_/_",
+		"/_synapse/admin/v1/whois/@alice:example.com":  "/_synapse/admin/v1/whois/_",
+		"/_matrix/client/unstable/rooms/!a:b/messages": "/_matrix/client/unstable/rooms/_/messages",
+		"/_matrix/client/unstable/keys/upload/DEVICE":  "/_matrix/client/unstable/keys/upload/_",
+	} {
+		if got := endpointFor(path); got != want {
+			t.Errorf("endpointFor(%q): want %q got %q", path, want, got)
+		}
+	}
+}
+
+func TestAddEndpoints(t *testing.T) {
+	defer func() {
+		addedTemplates = nil
+		rebuildEndpoints()
+	}()
+
+	if err := AddEndpoints([]string{"no/leading/slash"}); err == nil {
+		t.Error("want error for template without a leading slash")
+	}
+	if err := AddEndpoints([]string{
+		"/_custom/{thing}/info",
+		"/_matrix/client/r0/sync",
+		"/_matrix/client/r0/{custom}",
+		"/_matrix/client/r0/profile/@admin:example.com",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := endpointFor("/_custom/x/info"); got != "/_custom/_/info" {
+		t.Errorf("added endpoint: want %q got %q", "/_custom/_/info", got)
+	}
+	if got := endpointFor("/_matrix/client/r0/sync"); got != "/_matrix/client/r0/sync" {
+		t.Errorf("built in endpoint: want %q got %q", "/_matrix/client/r0/sync", got)
+	}
+	if got := endpointFor("/_matrix/client/r0/register"); got != "/_matrix/client/r0/register" {
+		t.Errorf("built in constant endpoint: want %q got %q", "/_matrix/client/r0/register", got)
+	}
+	want := "/_matrix/client/r0/profile/@admin:example.com"
+	if got := endpointFor(want); got != want {
+		t.Errorf("added constant endpoint: want %q got %q", want, got)
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// longPollEndpoints are the endpoints that hold a request open until either
+// new data arrives or the "timeout" given by the client expires.
+var longPollEndpoints = map[string]bool{
+	"/_matrix/client/api/v1/events": true,
+	"/_matrix/client/r0/events":     true,
+	"/_matrix/client/r0/sync":       true,
+	"/_matrix/client/v2_alpha/sync": true,
+}
+
+// longPollTimeout returns how long the request may wait on the server for new
+// data, and whether the request is a long-poll at all.
+func longPollTimeout(endpoint string, req *http.Request) (time.Duration, bool) {
+	if !longPollEndpoints[endpoint] {
+		return 0, false
+	}
+	timeout, err := strconv.ParseInt(req.URL.Query().Get("timeout"), 10, 64)
+	if err != nil || timeout <= 0 {
+		return 0, false
+	}
+	return time.Duration(timeout) * time.Millisecond, true
+}
+
+// longPollOutcome classifies a finished long-poll by whether the backend
+// returned early because data arrived or waited for the whole timeout.
+// Responses that weren't successful are classified as "error" so that they
+// aren't mistaken for data arriving.
+func longPollOutcome(statusCode int, duration, timeout time.Duration) string {
+	if statusCode < 200 || statusCode > 299 {
+		return "error"
+	}
+	if duration < timeout {
+		return "data"
+	}
+	return "timeout"
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Backend identifies the server that a request is proxied to.
+type Backend struct {
+	// Pool is the name of a group of interchangeable servers, e.g. "synchrotron".
+	Pool string
+	// Instance identifies a single server within the pool, usually by host:port.
+	Instance string
+}
+
+// Metrics holds the prometheus collectors that record proxied requests.
+// It implements prometheus.Collector so that it can be registered as a unit.
+type Metrics struct {
+	durations     *prometheus.HistogramVec
+	firstByte     *prometheus.HistogramVec
+	requestBytes  *prometheus.CounterVec
+	responseBytes *prometheus.CounterVec
+	inFlight      *prometheus.GaugeVec
+
+	longPollDurations *prometheus.HistogramVec
+	longPollWork      *prometheus.HistogramVec
+	longPollsOpen     *prometheus.GaugeVec
+}
+
+// Manually curated list of expected request timings.
+// Ranges from <1ms to <2 minutes, and then an auto-generated >2 minutes bucket.
+var durationBuckets = []float64{
+	// <1s
+	1000, 10000, 25000, 50000, 75000, 100000,
+	// <10s
+	1000000, 1250000, 1500000, 1750000, 2000000, 3000000, 4000000, 5000000,
+	// <60s
+	10000000, 20000000, 30000000, 45000000,
+	// >= 60s
+	60000000, 120000000,
+}
+
+// NewMetrics creates the collectors for proxied requests.
+// They need to be registered with prometheus before they are exported.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		durations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "synapse_proxy_request_durations_microseconds",
+				Help:    "Histogram of microsecond durations of requests to underlying synapse for proxied requests",
+				Buckets: durationBuckets,
+			},
+			[]string{"api", "path", "method", "status", "pool", "backend"},
+		),
+		firstByte: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "synapse_proxy_time_to_first_byte_microseconds",
+				Help: "Histogram of microseconds until the backend started responding to proxied requests. " +
+					"Long-polling requests that may wait for data are labelled separately.",
+				Buckets: durationBuckets,
+			},
+			[]string{"api", "path", "method", "pool", "backend", "long_poll"},
+		),
+		requestBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "synapse_proxy_request_bytes_total",
+				Help: "Number of request body bytes forwarded to the backend for proxied requests",
+			},
+			[]string{"api", "path", "method"},
+		),
+		responseBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "synapse_proxy_response_bytes_total",
+				Help: "Number of response body bytes returned to the client for proxied requests",
+			},
+			[]string{"api", "path", "method"},
+		),
+		inFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "synapse_proxy_requests_in_flight",
+				Help: "Number of proxied requests currently waiting on a backend pool",
+			},
+			[]string{"pool"},
+		),
+		longPollDurations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "synapse_proxy_long_poll_durations_microseconds",
+				Help: "Histogram of microsecond durations of long-polling requests, " +
+					"split by whether they returned early with data, waited for the client's timeout or failed",
+				Buckets: durationBuckets,
+			},
+			[]string{"api", "path", "method", "outcome", "pool", "backend"},
+		),
+		longPollWork: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "synapse_proxy_long_poll_work_microseconds",
+				Help: "Histogram of microseconds the backend spent responding to long-polling requests " +
+					"after their timeout woke them up. Long-polls that returned early with data aren't observed " +
+					"since when they were woken isn't known",
+				Buckets: durationBuckets,
+			},
+			[]string{"api", "path", "pool", "backend"},
+		),
+		longPollsOpen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "synapse_proxy_long_polls_open",
+				Help: "Number of long-polling requests currently held open by each backend",
+			},
+			[]string{"pool", "backend"},
+		),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.durations, m.firstByte, m.requestBytes, m.responseBytes, m.inFlight,
+		m.longPollDurations, m.longPollWork, m.longPollsOpen,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// statusClass groups HTTP status codes by their first digit, e.g. "2xx".
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// measuringResponseWriter records the status code, the size of the body and
+// when the first byte of the response was written.
+type measuringResponseWriter struct {
+	http.ResponseWriter
+	start      time.Time
+	statusCode int
+	firstByte  time.Duration
+	bytes      int64
+}
+
+func (w *measuringResponseWriter) WriteHeader(code int) {
+	// Informational 1xx responses may precede the final response header.
+	if w.statusCode == 0 && code >= 200 {
+		w.statusCode = code
+		w.firstByte = time.Now().Sub(w.start)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *measuringResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+		w.firstByte = time.Now().Sub(w.start)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher so that streamed responses from the reverse
+// proxy reach the client promptly.
+func (w *measuringResponseWriter) Flush() {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+		w.firstByte = time.Now().Sub(w.start)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (w *measuringResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A StatusRecorder is an http.ResponseWriter that remembers the status code
+// of the response written through it.
+type StatusRecorder struct {
+	http.ResponseWriter
+	// Status is the status code of the response, or 0 if nothing has been
+	// written yet.
+	Status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *StatusRecorder) WriteHeader(status int) {
+	// Informational 1xx responses may precede the final response header.
+	if r.Status == 0 && status >= 200 {
+		r.Status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (r *StatusRecorder) Flush() {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// A CountingReader counts the bytes of a request body read through it. The
+// count is updated atomically because the transport may read the body from
+// another goroutine.
+type CountingReader struct {
+	io.ReadCloser
+	// OnLimit, if set, is called the first time reading fails because the
+	// body is over the limit of an http.MaxBytesReader.
+	OnLimit func()
+
+	bytes   int64
+	limited bool
+}
+
+// Read implements io.Reader
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.bytes, int64(n))
+	var maxBytesErr *http.MaxBytesError
+	if err != nil && r.OnLimit != nil && !r.limited && errors.As(err, &maxBytesErr) {
+		r.limited = true
+		r.OnLimit()
+	}
+	return n, err
+}
+
+// Count returns the number of bytes read so far.
+func (r *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&r.bytes)
+}
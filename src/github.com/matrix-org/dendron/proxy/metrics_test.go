@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMeasureByPath(t *testing.T) {
+	metrics := NewMetrics()
+	backend := Backend{Pool: "synapse", Instance: "localhost:18448"}
+	handler := MeasureByPath(metrics, backend, func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+	})
+
+	req := httptest.NewRequest("PUT", "/_matrix/client/r0/rooms/!a:b/send/m.room.message/1", strings.NewReader("{}"))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("status code: want 404 got %d", w.Code)
+	}
+
+	endpoint := "/_matrix/client/r0/rooms/_/send/_/_"
+	var m dto.Metric
+	metrics.durations.WithLabelValues("client", endpoint, "PUT", "4xx", "synapse", "localhost:18448").Write(&m)
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("durations: want 1 sample got %d", got)
+	}
+	metrics.requestBytes.WithLabelValues("client", endpoint, "PUT").Write(&m)
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Errorf("request bytes: want 2 got %v", got)
+	}
+	metrics.responseBytes.WithLabelValues("client", endpoint, "PUT").Write(&m)
+	if got := m.GetCounter().GetValue(); got != 9 {
+		t.Errorf("response bytes: want 9 got %v", got)
+	}
+	metrics.inFlight.WithLabelValues("synapse").Write(&m)
+	if got := m.GetGauge().GetValue(); got != 0 {
+		t.Errorf("in flight: want 0 got %v", got)
+	}
+}
+
+func TestMeasureByPathLongPoll(t *testing.T) {
+	metrics := NewMetrics()
+	backend := Backend{Pool: "synchrotron", Instance: "localhost:18449"}
+	handler := MeasureByPath(metrics, backend, func(w http.ResponseWriter, req *http.Request) {
+		var m dto.Metric
+		metrics.longPollsOpen.WithLabelValues("synchrotron", "localhost:18449").Write(&m)
+		if got := m.GetGauge().GetValue(); got != 1 {
+			t.Errorf("open long-polls during request: want 1 got %v", got)
+		}
+		if req.URL.Query().Get("since") == "" {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if req.URL.Query().Get("since") == "bad" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte("{}"))
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/_matrix/client/r0/sync?timeout=1", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/_matrix/client/r0/sync?timeout=1000&since=s1", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/_matrix/client/r0/sync?timeout=1000&since=bad", nil))
+
+	var m dto.Metric
+	for _, outcome := range []string{"data", "timeout", "error"} {
+		metrics.longPollDurations.WithLabelValues(
+			"client", "/_matrix/client/r0/sync", "GET", outcome, "synchrotron", "localhost:18449",
+		).Write(&m)
+		if got := m.GetHistogram().GetSampleCount(); got != 1 {
+			t.Errorf("%s long-polls: want 1 sample got %d", outcome, got)
+		}
+	}
+	metrics.longPollWork.WithLabelValues("client", "/_matrix/client/r0/sync", "synchrotron", "localhost:18449").Write(&m)
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("long-poll work: want 1 sample got %d", got)
+	}
+	metrics.durations.WithLabelValues(
+		"client", "/_matrix/client/r0/sync", "GET", "2xx", "synchrotron", "localhost:18449",
+	).Write(&m)
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("durations: want 2 successful long-polls got %d samples", got)
+	}
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want bool
+	}{
+		{"/_matrix/client/r0/sync?timeout=30000", true},
+		{"/_matrix/client/r0/sync?timeout=0", false},
+		{"/_matrix/client/r0/sync", false},
+		{"/_matrix/client/api/v1/events?timeout=30000", true},
+		{"/_matrix/client/r0/publicRooms?timeout=30000", false},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		if _, got := longPollTimeout(endpointFor(req.URL.Path), req); got != tc.want {
+			t.Errorf("longPollTimeout(%q): want long-poll %v got %v", tc.url, tc.want, got)
+		}
+	}
+}
@@ -5,178 +5,154 @@ package proxy
 
 //go:generate python ../../../../../scripts/generate_proxy_paths.py ../../../../../vendor/src/github.com/matrix-org/matrix-doc
 
-import "regexp"
-
-var unknownPath = "unknown path"
-
-type regexpAndString struct {
-	re *regexp.Regexp
-	s  string
-}
-
-var (
-	constantPaths = make(map[string]bool)
-	regexpPaths   []regexpAndString
-)
-
-func endpointFor(path string) string {
-	if ok := constantPaths[path]; ok {
-		return path
-	}
-	for _, i := range regexpPaths {
-		if i.re.MatchString(path) {
-			return i.s
-		}
-	}
-	return unknownPath
-}
-
-func init() {
-	constantPaths[`/_matrix/client/api/v1/createRoom`] = true
-	constantPaths[`/_matrix/client/api/v1/events`] = true
-	constantPaths[`/_matrix/client/api/v1/initialSync`] = true
-	constantPaths[`/_matrix/client/api/v1/login`] = true
-	constantPaths[`/_matrix/client/api/v1/login/cas/redirect`] = true
-	constantPaths[`/_matrix/client/api/v1/login/cas/ticket`] = true
-	constantPaths[`/_matrix/client/api/v1/logout`] = true
-	constantPaths[`/_matrix/client/api/v1/lookup`] = true
-	constantPaths[`/_matrix/client/api/v1/notifications`] = true
-	constantPaths[`/_matrix/client/api/v1/notify`] = true
-	constantPaths[`/_matrix/client/api/v1/pubkey/ephemeral/isvalid`] = true
-	constantPaths[`/_matrix/client/api/v1/pubkey/isvalid`] = true
-	constantPaths[`/_matrix/client/api/v1/publicRooms`] = true
-	constantPaths[`/_matrix/client/api/v1/pushers`] = true
-	constantPaths[`/_matrix/client/api/v1/pushers/set`] = true
-	constantPaths[`/_matrix/client/api/v1/pushrules/`] = true
-	constantPaths[`/_matrix/client/api/v1/search`] = true
-	constantPaths[`/_matrix/client/api/v1/versions`] = true
-	constantPaths[`/_matrix/client/api/v1/voip/turnServer`] = true
-	constantPaths[`/_matrix/client/r0/account/3pid`] = true
-	constantPaths[`/_matrix/client/r0/account/3pid/email/requestToken`] = true
-	constantPaths[`/_matrix/client/r0/account/deactivate`] = true
-	constantPaths[`/_matrix/client/r0/account/password`] = true
-	constantPaths[`/_matrix/client/r0/account/password/email/requestToken`] = true
-	constantPaths[`/_matrix/client/r0/createRoom`] = true
-	constantPaths[`/_matrix/client/r0/events`] = true
-	constantPaths[`/_matrix/client/r0/initialSync`] = true
-	constantPaths[`/_matrix/client/r0/login`] = true
-	constantPaths[`/_matrix/client/r0/login/cas/redirect`] = true
-	constantPaths[`/_matrix/client/r0/login/cas/ticket`] = true
-	constantPaths[`/_matrix/client/r0/logout`] = true
-	constantPaths[`/_matrix/client/r0/lookup`] = true
-	constantPaths[`/_matrix/client/r0/notifications`] = true
-	constantPaths[`/_matrix/client/r0/notify`] = true
-	constantPaths[`/_matrix/client/r0/pubkey/ephemeral/isvalid`] = true
-	constantPaths[`/_matrix/client/r0/pubkey/isvalid`] = true
-	constantPaths[`/_matrix/client/r0/publicRooms`] = true
-	constantPaths[`/_matrix/client/r0/pushers`] = true
-	constantPaths[`/_matrix/client/r0/pushers/set`] = true
-	constantPaths[`/_matrix/client/r0/pushrules/`] = true
-	constantPaths[`/_matrix/client/r0/register`] = true
-	constantPaths[`/_matrix/client/r0/register/email/requestToken`] = true
-	constantPaths[`/_matrix/client/r0/search`] = true
-	constantPaths[`/_matrix/client/r0/sync`] = true
-	constantPaths[`/_matrix/client/r0/versions`] = true
-	constantPaths[`/_matrix/client/r0/voip/turnServer`] = true
-	constantPaths[`/_matrix/client/v2_alpha/account/3pid`] = true
-	constantPaths[`/_matrix/client/v2_alpha/account/3pid/email/requestToken`] = true
-	constantPaths[`/_matrix/client/v2_alpha/account/deactivate`] = true
-	constantPaths[`/_matrix/client/v2_alpha/account/password`] = true
-	constantPaths[`/_matrix/client/v2_alpha/account/password/email/requestToken`] = true
-	constantPaths[`/_matrix/client/v2_alpha/register`] = true
-	constantPaths[`/_matrix/client/v2_alpha/register/email/requestToken`] = true
-	constantPaths[`/_matrix/client/v2_alpha/sync`] = true
-	constantPaths[`/_matrix/media/api/v1/upload`] = true
-	constantPaths[`/_matrix/media/r0/upload`] = true
-
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/admin/whois/[^/]*$`), `/_matrix/client/api/v1/admin/whois/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/events/[^/]*$`), `/_matrix/client/api/v1/events/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/join/[^/]*$`), `/_matrix/client/api/v1/join/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/presence/[^/]*/status$`), `/_matrix/client/api/v1/presence/_/status`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/presence/list/[^/]*$`), `/_matrix/client/api/v1/presence/list/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/profile/[^/]*$`), `/_matrix/client/api/v1/profile/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/profile/[^/]*/avatar_url$`), `/_matrix/client/api/v1/profile/_/avatar_url`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/profile/[^/]*/displayname$`), `/_matrix/client/api/v1/profile/_/displayname`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/pubkey/[^/]*$`), `/_matrix/client/api/v1/pubkey/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/pushrules/[^/]*/[^/]*/[^/]*$`), `/_matrix/client/api/v1/pushrules/_/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/pushrules/[^/]*/[^/]*/[^/]*/actions$`), `/_matrix/client/api/v1/pushrules/_/_/_/actions`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/pushrules/[^/]*/[^/]*/[^/]*/enabled$`), `/_matrix/client/api/v1/pushrules/_/_/_/enabled`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/room/[^/]*$`), `/_matrix/client/api/v1/room/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*$`), `/_matrix/client/api/v1/rooms/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/ban$`), `/_matrix/client/api/v1/rooms/_/ban`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/context/[^/]*$`), `/_matrix/client/api/v1/rooms/_/context/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/forget$`), `/_matrix/client/api/v1/rooms/_/forget`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/initialSync$`), `/_matrix/client/api/v1/rooms/_/initialSync`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/invite$`), `/_matrix/client/api/v1/rooms/_/invite`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/invite $`), `/_matrix/client/api/v1/rooms/_/invite `})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/join$`), `/_matrix/client/api/v1/rooms/_/join`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/kick$`), `/_matrix/client/api/v1/rooms/_/kick`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/leave$`), `/_matrix/client/api/v1/rooms/_/leave`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/members$`), `/_matrix/client/api/v1/rooms/_/members`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/messages$`), `/_matrix/client/api/v1/rooms/_/messages`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/redact/[^/]*/[^/]*$`), `/_matrix/client/api/v1/rooms/_/redact/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/send/[^/]*/[^/]*$`), `/_matrix/client/api/v1/rooms/_/send/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/state$`), `/_matrix/client/api/v1/rooms/_/state`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/state/[^/]*$`), `/_matrix/client/api/v1/rooms/_/state/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/state/[^/]*/[^/]*$`), `/_matrix/client/api/v1/rooms/_/state/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/typing/[^/]*$`), `/_matrix/client/api/v1/rooms/_/typing/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/rooms/[^/]*/unban$`), `/_matrix/client/api/v1/rooms/_/unban`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/sendToDevice/[^/]*/[^/]*$`), `/_matrix/client/api/v1/sendToDevice/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/api/v1/transactions/[^/]*$`), `/_matrix/client/api/v1/transactions/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/admin/whois/[^/]*$`), `/_matrix/client/r0/admin/whois/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/events/[^/]*$`), `/_matrix/client/r0/events/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/join/[^/]*$`), `/_matrix/client/r0/join/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/presence/[^/]*/status$`), `/_matrix/client/r0/presence/_/status`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/presence/list/[^/]*$`), `/_matrix/client/r0/presence/list/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/profile/[^/]*$`), `/_matrix/client/r0/profile/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/profile/[^/]*/avatar_url$`), `/_matrix/client/r0/profile/_/avatar_url`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/profile/[^/]*/displayname$`), `/_matrix/client/r0/profile/_/displayname`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/pubkey/[^/]*$`), `/_matrix/client/r0/pubkey/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/pushrules/[^/]*/[^/]*/[^/]*$`), `/_matrix/client/r0/pushrules/_/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/pushrules/[^/]*/[^/]*/[^/]*/actions$`), `/_matrix/client/r0/pushrules/_/_/_/actions`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/pushrules/[^/]*/[^/]*/[^/]*/enabled$`), `/_matrix/client/r0/pushrules/_/_/_/enabled`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/room/[^/]*$`), `/_matrix/client/r0/room/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*$`), `/_matrix/client/r0/rooms/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/ban$`), `/_matrix/client/r0/rooms/_/ban`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/context/[^/]*$`), `/_matrix/client/r0/rooms/_/context/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/forget$`), `/_matrix/client/r0/rooms/_/forget`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/initialSync$`), `/_matrix/client/r0/rooms/_/initialSync`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/invite$`), `/_matrix/client/r0/rooms/_/invite`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/invite $`), `/_matrix/client/r0/rooms/_/invite `})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/join$`), `/_matrix/client/r0/rooms/_/join`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/kick$`), `/_matrix/client/r0/rooms/_/kick`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/leave$`), `/_matrix/client/r0/rooms/_/leave`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/members$`), `/_matrix/client/r0/rooms/_/members`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/messages$`), `/_matrix/client/r0/rooms/_/messages`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/receipt/[^/]*/[^/]*$`), `/_matrix/client/r0/rooms/_/receipt/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/redact/[^/]*/[^/]*$`), `/_matrix/client/r0/rooms/_/redact/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/send/[^/]*/[^/]*$`), `/_matrix/client/r0/rooms/_/send/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/state$`), `/_matrix/client/r0/rooms/_/state`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/state/[^/]*$`), `/_matrix/client/r0/rooms/_/state/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/state/[^/]*/[^/]*$`), `/_matrix/client/r0/rooms/_/state/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/typing/[^/]*$`), `/_matrix/client/r0/rooms/_/typing/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/rooms/[^/]*/unban$`), `/_matrix/client/r0/rooms/_/unban`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/sendToDevice/[^/]*/[^/]*$`), `/_matrix/client/r0/sendToDevice/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/transactions/[^/]*$`), `/_matrix/client/r0/transactions/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/user/[^/]*/account_data/[^/]*$`), `/_matrix/client/r0/user/_/account_data/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/user/[^/]*/filter$`), `/_matrix/client/r0/user/_/filter`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/user/[^/]*/filter/[^/]*$`), `/_matrix/client/r0/user/_/filter/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/user/[^/]*/rooms/[^/]*/account_data/[^/]*$`), `/_matrix/client/r0/user/_/rooms/_/account_data/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/user/[^/]*/rooms/[^/]*/tags$`), `/_matrix/client/r0/user/_/rooms/_/tags`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/user/[^/]*/rooms/[^/]*/tags/[^/]*$`), `/_matrix/client/r0/user/_/rooms/_/tags/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/r0/users/[^/]*$`), `/_matrix/client/r0/users/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/rooms/[^/]*/receipt/[^/]*/[^/]*$`), `/_matrix/client/v2_alpha/rooms/_/receipt/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/user/[^/]*/account_data/[^/]*$`), `/_matrix/client/v2_alpha/user/_/account_data/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/user/[^/]*/filter$`), `/_matrix/client/v2_alpha/user/_/filter`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/user/[^/]*/filter/[^/]*$`), `/_matrix/client/v2_alpha/user/_/filter/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/user/[^/]*/rooms/[^/]*/account_data/[^/]*$`), `/_matrix/client/v2_alpha/user/_/rooms/_/account_data/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/user/[^/]*/rooms/[^/]*/tags$`), `/_matrix/client/v2_alpha/user/_/rooms/_/tags`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/user/[^/]*/rooms/[^/]*/tags/[^/]*$`), `/_matrix/client/v2_alpha/user/_/rooms/_/tags/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/client/v2_alpha/users/[^/]*$`), `/_matrix/client/v2_alpha/users/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/media/api/v1/download/[^/]*/[^/]*$`), `/_matrix/media/api/v1/download/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/media/api/v1/download/[^/]*/[^/]*/[^/]*$`), `/_matrix/media/api/v1/download/_/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/media/api/v1/thumbnail/[^/]*/[^/]*$`), `/_matrix/media/api/v1/thumbnail/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/media/r0/download/[^/]*/[^/]*$`), `/_matrix/media/r0/download/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/media/r0/download/[^/]*/[^/]*/[^/]*$`), `/_matrix/media/r0/download/_/_/_`})
-	regexpPaths = append(regexpPaths, regexpAndString{regexp.MustCompile(`^/_matrix/media/r0/thumbnail/[^/]*/[^/]*$`), `/_matrix/media/r0/thumbnail/_/_`})
+// endpointTemplates are the paths of the known endpoints, with path parameters
+// written as {param}. If a path matches more than one template then the one
+// listed first is used.
+var endpointTemplates = []string{
+	`/_matrix/client/api/v1/createRoom`,
+	`/_matrix/client/api/v1/events`,
+	`/_matrix/client/api/v1/initialSync`,
+	`/_matrix/client/api/v1/login`,
+	`/_matrix/client/api/v1/login/cas/redirect`,
+	`/_matrix/client/api/v1/login/cas/ticket`,
+	`/_matrix/client/api/v1/logout`,
+	`/_matrix/client/api/v1/lookup`,
+	`/_matrix/client/api/v1/notifications`,
+	`/_matrix/client/api/v1/notify`,
+	`/_matrix/client/api/v1/pubkey/ephemeral/isvalid`,
+	`/_matrix/client/api/v1/pubkey/isvalid`,
+	`/_matrix/client/api/v1/publicRooms`,
+	`/_matrix/client/api/v1/pushers`,
+	`/_matrix/client/api/v1/pushers/set`,
+	`/_matrix/client/api/v1/pushrules/`,
+	`/_matrix/client/api/v1/search`,
+	`/_matrix/client/api/v1/versions`,
+	`/_matrix/client/api/v1/voip/turnServer`,
+	`/_matrix/client/r0/account/3pid`,
+	`/_matrix/client/r0/account/3pid/email/requestToken`,
+	`/_matrix/client/r0/account/deactivate`,
+	`/_matrix/client/r0/account/password`,
+	`/_matrix/client/r0/account/password/email/requestToken`,
+	`/_matrix/client/r0/createRoom`,
+	`/_matrix/client/r0/events`,
+	`/_matrix/client/r0/initialSync`,
+	`/_matrix/client/r0/login`,
+	`/_matrix/client/r0/login/cas/redirect`,
+	`/_matrix/client/r0/login/cas/ticket`,
+	`/_matrix/client/r0/logout`,
+	`/_matrix/client/r0/lookup`,
+	`/_matrix/client/r0/notifications`,
+	`/_matrix/client/r0/notify`,
+	`/_matrix/client/r0/pubkey/ephemeral/isvalid`,
+	`/_matrix/client/r0/pubkey/isvalid`,
+	`/_matrix/client/r0/publicRooms`,
+	`/_matrix/client/r0/pushers`,
+	`/_matrix/client/r0/pushers/set`,
+	`/_matrix/client/r0/pushrules/`,
+	`/_matrix/client/r0/register`,
+	`/_matrix/client/r0/register/email/requestToken`,
+	`/_matrix/client/r0/search`,
+	`/_matrix/client/r0/sync`,
+	`/_matrix/client/r0/versions`,
+	`/_matrix/client/r0/voip/turnServer`,
+	`/_matrix/client/v2_alpha/account/3pid`,
+	`/_matrix/client/v2_alpha/account/3pid/email/requestToken`,
+	`/_matrix/client/v2_alpha/account/deactivate`,
+	`/_matrix/client/v2_alpha/account/password`,
+	`/_matrix/client/v2_alpha/account/password/email/requestToken`,
+	`/_matrix/client/v2_alpha/register`,
+	`/_matrix/client/v2_alpha/register/email/requestToken`,
+	`/_matrix/client/v2_alpha/sync`,
+	`/_matrix/media/api/v1/upload`,
+	`/_matrix/media/r0/upload`,
+	`/_matrix/client/api/v1/admin/whois/{userId}`,
+	`/_matrix/client/api/v1/events/{eventId}`,
+	`/_matrix/client/api/v1/join/{roomIdOrAlias}`,
+	`/_matrix/client/api/v1/presence/{userId}/status`,
+	`/_matrix/client/api/v1/presence/list/{userId}`,
+	`/_matrix/client/api/v1/profile/{userId}`,
+	`/_matrix/client/api/v1/profile/{userId}/avatar_url`,
+	`/_matrix/client/api/v1/profile/{userId}/displayname`,
+	`/_matrix/client/api/v1/pubkey/{keyId}`,
+	`/_matrix/client/api/v1/pushrules/{scope}/{kind}/{ruleId}`,
+	`/_matrix/client/api/v1/pushrules/{scope}/{kind}/{ruleId}/actions`,
+	`/_matrix/client/api/v1/pushrules/{scope}/{kind}/{ruleId}/enabled`,
+	`/_matrix/client/api/v1/room/{roomAlias}`,
+	`/_matrix/client/api/v1/rooms/{roomAlias}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/ban`,
+	`/_matrix/client/api/v1/rooms/{roomId}/context/{eventId}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/forget`,
+	`/_matrix/client/api/v1/rooms/{roomId}/initialSync`,
+	`/_matrix/client/api/v1/rooms/{roomId}/invite`,
+	`/_matrix/client/api/v1/rooms/{roomId}/invite `,
+	`/_matrix/client/api/v1/rooms/{roomId}/join`,
+	`/_matrix/client/api/v1/rooms/{roomId}/kick`,
+	`/_matrix/client/api/v1/rooms/{roomId}/leave`,
+	`/_matrix/client/api/v1/rooms/{roomId}/members`,
+	`/_matrix/client/api/v1/rooms/{roomId}/messages`,
+	`/_matrix/client/api/v1/rooms/{roomId}/redact/{eventId}/{txnId}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/send/{eventType}/{txnId}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/state`,
+	`/_matrix/client/api/v1/rooms/{roomId}/state/{eventType}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/state/{eventType}/{stateKey}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/typing/{userId}`,
+	`/_matrix/client/api/v1/rooms/{roomId}/unban`,
+	`/_matrix/client/api/v1/sendToDevice/{eventType}/{txnId}`,
+	`/_matrix/client/api/v1/transactions/{txnId}`,
+	`/_matrix/client/r0/admin/whois/{userId}`,
+	`/_matrix/client/r0/events/{eventId}`,
+	`/_matrix/client/r0/join/{roomIdOrAlias}`,
+	`/_matrix/client/r0/presence/{userId}/status`,
+	`/_matrix/client/r0/presence/list/{userId}`,
+	`/_matrix/client/r0/profile/{userId}`,
+	`/_matrix/client/r0/profile/{userId}/avatar_url`,
+	`/_matrix/client/r0/profile/{userId}/displayname`,
+	`/_matrix/client/r0/pubkey/{keyId}`,
+	`/_matrix/client/r0/pushrules/{scope}/{kind}/{ruleId}`,
+	`/_matrix/client/r0/pushrules/{scope}/{kind}/{ruleId}/actions`,
+	`/_matrix/client/r0/pushrules/{scope}/{kind}/{ruleId}/enabled`,
+	`/_matrix/client/r0/room/{roomAlias}`,
+	`/_matrix/client/r0/rooms/{roomAlias}`,
+	`/_matrix/client/r0/rooms/{roomId}/ban`,
+	`/_matrix/client/r0/rooms/{roomId}/context/{eventId}`,
+	`/_matrix/client/r0/rooms/{roomId}/forget`,
+	`/_matrix/client/r0/rooms/{roomId}/initialSync`,
+	`/_matrix/client/r0/rooms/{roomId}/invite`,
+	`/_matrix/client/r0/rooms/{roomId}/invite `,
+	`/_matrix/client/r0/rooms/{roomId}/join`,
+	`/_matrix/client/r0/rooms/{roomId}/kick`,
+	`/_matrix/client/r0/rooms/{roomId}/leave`,
+	`/_matrix/client/r0/rooms/{roomId}/members`,
+	`/_matrix/client/r0/rooms/{roomId}/messages`,
+	`/_matrix/client/r0/rooms/{roomId}/receipt/{receiptType}/{eventId}`,
+	`/_matrix/client/r0/rooms/{roomId}/redact/{eventId}/{txnId}`,
+	`/_matrix/client/r0/rooms/{roomId}/send/{eventType}/{txnId}`,
+	`/_matrix/client/r0/rooms/{roomId}/state`,
+	`/_matrix/client/r0/rooms/{roomId}/state/{eventType}`,
+	`/_matrix/client/r0/rooms/{roomId}/state/{eventType}/{stateKey}`,
+	`/_matrix/client/r0/rooms/{roomId}/typing/{userId}`,
+	`/_matrix/client/r0/rooms/{roomId}/unban`,
+	`/_matrix/client/r0/sendToDevice/{eventType}/{txnId}`,
+	`/_matrix/client/r0/transactions/{txnId}`,
+	`/_matrix/client/r0/user/{userId}/account_data/{type}`,
+	`/_matrix/client/r0/user/{userId}/filter`,
+	`/_matrix/client/r0/user/{userId}/filter/{filterId}`,
+	`/_matrix/client/r0/user/{userId}/rooms/{roomId}/account_data/{type}`,
+	`/_matrix/client/r0/user/{userId}/rooms/{roomId}/tags`,
+	`/_matrix/client/r0/user/{userId}/rooms/{roomId}/tags/{tag}`,
+	`/_matrix/client/r0/users/{userId}`,
+	`/_matrix/client/v2_alpha/rooms/{roomId}/receipt/{receiptType}/{eventId}`,
+	`/_matrix/client/v2_alpha/user/{userId}/account_data/{type}`,
+	`/_matrix/client/v2_alpha/user/{userId}/filter`,
+	`/_matrix/client/v2_alpha/user/{userId}/filter/{filterId}`,
+	`/_matrix/client/v2_alpha/user/{userId}/rooms/{roomId}/account_data/{type}`,
+	`/_matrix/client/v2_alpha/user/{userId}/rooms/{roomId}/tags`,
+	`/_matrix/client/v2_alpha/user/{userId}/rooms/{roomId}/tags/{tag}`,
+	`/_matrix/client/v2_alpha/users/{userId}`,
+	`/_matrix/media/api/v1/download/{serverName}/{mediaId}`,
+	`/_matrix/media/api/v1/download/{serverName}/{mediaId}/{fileName}`,
+	`/_matrix/media/api/v1/thumbnail/{serverName}/{mediaId}`,
+	`/_matrix/media/r0/download/{serverName}/{mediaId}`,
+	`/_matrix/media/r0/download/{serverName}/{mediaId}/{fileName}`,
+	`/_matrix/media/r0/thumbnail/{serverName}/{mediaId}`,
 }
@@ -3,11 +3,12 @@ package proxy
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/matrix-org/dendron/clientip"
 )
 
 // An HTTPError is the information needed to make an error response for a
@@ -24,6 +25,9 @@ type HTTPError struct {
 	// Message is an escaped JSON string to return in the "message" part of the
 	// JSON response.
 	Message string
+	// RetryAfter is how long the client should wait before retrying, returned
+	// as "retry_after_ms" if it is set.
+	RetryAfter time.Duration
 }
 
 // SetHeaders sets the "Content-Type" to "application/json" and sets CORS
@@ -44,31 +48,124 @@ func LogAndReplyError(w http.ResponseWriter, httpError *HTTPError) {
 		"errCode":    httpError.ErrCode,
 	}).Print("Responding with error")
 	SetHeaders(w)
+	if httpError.RetryAfter > 0 {
+		retryAfterMs := int64((httpError.RetryAfter + time.Millisecond - 1) / time.Millisecond)
+		w.Header().Set("Retry-After", strconv.FormatInt((retryAfterMs+999)/1000, 10))
+		w.WriteHeader(httpError.StatusCode)
+		fmt.Fprintf(w, `{"errcode":"%s","error":"%s","retry_after_ms":%d}`, httpError.ErrCode, httpError.Message, retryAfterMs)
+		return
+	}
 	w.WriteHeader(httpError.StatusCode)
 	fmt.Fprintf(w, `{"errcode":"%s","error":"%s"}`, httpError.ErrCode, httpError.Message)
 }
 
-// MeasureByPath records how long the requests take to process in a histogram labeled by path.
-func MeasureByPath(metrics *prometheus.HistogramVec, fn http.HandlerFunc) http.HandlerFunc {
+// MeasureByPath records how long the requests take to process, how many bytes
+// they transfer and how many are in flight, labeled by path and backend.
+// Long-polling requests are additionally recorded in their own histograms since
+// their duration mostly depends on the timeout the client asked for.
+func MeasureByPath(metrics *Metrics, backend Backend, fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		m := measurement{
+			backend:  backend,
+			method:   req.Method,
+			api:      apiFor(req.URL.Path),
+			endpoint: endpointFor(req.URL.Path),
+		}
+		if m.endpoint == unknownPath {
+			log.WithFields(log.Fields{
+				"path":     req.URL.Path,
+				"clientIP": clientip.FromRequest(req),
+			}).Warn("Proxying unknown path")
+		}
+		m.timeout, m.longPoll = longPollTimeout(m.endpoint, req)
+
+		inFlight := metrics.inFlight.WithLabelValues(backend.Pool)
+		inFlight.Inc()
+		defer inFlight.Dec()
+		if m.longPoll {
+			open := metrics.longPollsOpen.WithLabelValues(backend.Pool, backend.Instance)
+			open.Inc()
+			defer open.Dec()
+		}
+
 		start := time.Now()
-		fn(w, req)
-		record(metrics, req, start)
+		mw := &measuringResponseWriter{ResponseWriter: w, start: start}
+		var body *CountingReader
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &CountingReader{ReadCloser: req.Body}
+			req.Body = body
+		}
+		fn(mw, req)
+
+		m.duration = time.Now().Sub(start)
+		m.statusCode = mw.statusCode
+		m.firstByte = mw.firstByte
+		if m.statusCode == 0 {
+			// The handler didn't write anything so net/http will send an empty 200.
+			m.statusCode = http.StatusOK
+			m.firstByte = m.duration
+		}
+		if body != nil {
+			m.requestBytes = body.Count()
+		}
+		m.responseBytes = mw.bytes
+		m.record(metrics)
 	}
 }
 
-func record(metrics *prometheus.HistogramVec, req *http.Request, start time.Time) {
-	sanitizedPath := endpointFor(req.URL.Path)
-	if sanitizedPath == unknownPath {
-		log.WithField("path", req.URL.Path).Warn("Proxying unknown path")
-	}
-	metric, err := metrics.GetMetricWithLabelValues(sanitizedPath, req.Method)
+// A measurement is everything recorded about a single proxied request.
+type measurement struct {
+	backend       Backend
+	method        string
+	api           string
+	endpoint      string
+	longPoll      bool
+	timeout       time.Duration
+	statusCode    int
+	duration      time.Duration
+	firstByte     time.Duration
+	requestBytes  int64
+	responseBytes int64
+}
+
+func (m *measurement) record(metrics *Metrics) {
+	metric, err := metrics.durations.GetMetricWithLabelValues(
+		m.api, m.endpoint, m.method, statusClass(m.statusCode), m.backend.Pool, m.backend.Instance,
+	)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"path":   req.URL.Path,
-			"method": req.Method,
+			"path":   m.endpoint,
+			"method": m.method,
 		}).Print("Error getting proxy metric")
 	} else {
-		metric.Observe(float64(time.Now().Sub(start).Nanoseconds() / 1000))
+		metric.Observe(microseconds(m.duration))
 	}
+
+	if m.longPoll {
+		outcome := longPollOutcome(m.statusCode, m.duration, m.timeout)
+		metrics.longPollDurations.WithLabelValues(
+			m.api, m.endpoint, m.method, outcome, m.backend.Pool, m.backend.Instance,
+		).Observe(microseconds(m.duration))
+		if outcome == "timeout" {
+			// Only long-polls woken by the timeout are recorded, since for
+			// those we know the backend started working when the timeout
+			// expired. A long-poll woken by data may have been woken at any
+			// point, so how long it spent working can't be told apart from
+			// how long it waited and it would only skew the histogram.
+			metrics.longPollWork.WithLabelValues(
+				m.api, m.endpoint, m.backend.Pool, m.backend.Instance,
+			).Observe(microseconds(m.duration - m.timeout))
+		}
+	}
+
+	metrics.firstByte.WithLabelValues(
+		m.api, m.endpoint, m.method, m.backend.Pool, m.backend.Instance, strconv.FormatBool(m.longPoll),
+	).Observe(microseconds(m.firstByte))
+
+	metrics.requestBytes.WithLabelValues(m.api, m.endpoint, m.method).Add(float64(m.requestBytes))
+	metrics.responseBytes.WithLabelValues(m.api, m.endpoint, m.method).Add(float64(m.responseBytes))
+}
+
+func microseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds() / 1000)
 }
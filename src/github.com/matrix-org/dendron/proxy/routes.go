@@ -0,0 +1,23 @@
+package proxy
+
+import "regexp"
+
+// apiVersion matches the version part of an API path. It includes api/v1,
+// which has a slash in it, so can't be matched as a single path segment.
+const apiVersion = `(?:api/v1|r0|unstable|v[0-9.]+)`
+
+// ClientPath compiles a regular expression for paths of the client-server API
+// of any version, where pattern matches the rest of the path after the version.
+func ClientPath(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`^/_matrix/client/` + apiVersion + `/` + pattern)
+}
+
+// MediaPath compiles a regular expression for paths of the media API of any
+// version, where pattern matches the rest of the path after the version.
+func MediaPath(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`^/_matrix/media/` + apiVersion + `/` + pattern)
+}
+
+// UploadPath matches the media upload endpoints, both for new uploads and for
+// content uploaded to a media ID created beforehand.
+var UploadPath = MediaPath(`upload(/|$)`)
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// v2AlphaPaths are the client-server paths that were served under the
+// v2_alpha prefix rather than api/v1 before r0.
+var v2AlphaPaths = []string{"/account", "/register", "/rooms/{roomId}/receipt", "/sync", "/tokenrefresh", "/user"}
+
+// mediaPaths are the paths that are served under the media API prefix rather
+// than the client-server one.
+var mediaPaths = []string{"/download", "/thumbnail", "/upload"}
+
+// LoadEndpointSpecs reads the swagger API specs under dir and uses the paths
+// in them to label metrics instead of the paths generated from matrix-doc at
+// build time. The dir can either be a matrix-doc checkout or a directory of
+// swagger YAML or JSON files.
+func LoadEndpointSpecs(dir string) error {
+	templates, err := readSpecs(dir)
+	if err != nil {
+		return err
+	}
+	if len(templates) == 0 {
+		return fmt.Errorf("no API paths found in %q", dir)
+	}
+	catalogueMutex.Lock()
+	defer catalogueMutex.Unlock()
+	specTemplates = templates
+	rebuildEndpoints()
+	return nil
+}
+
+// readSpecs returns the endpoint templates for every path in the specs under
+// dir, in the same order as scripts/generate_proxy_paths.py lists them:
+// constant paths come first then the templated paths, sorted as if their
+// parameters were the regular expressions that endpoints used to be matched
+// with.
+func readSpecs(dir string) ([]string, error) {
+	// If this is a matrix-doc checkout then only look at the API specs.
+	if info, err := os.Stat(filepath.Join(dir, "api")); err == nil && info.IsDir() {
+		dir = filepath.Join(dir, "api")
+	}
+
+	constant := make(map[string]bool)
+	templated := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if info.IsDir() || (ext != ".yaml" && ext != ".json") {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var paths []string
+		if ext == ".json" {
+			paths, err = readJSONSpec(f)
+		} else {
+			paths, err = readYAMLSpec(f)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading API spec %q: %v", path, err)
+		}
+		for _, p := range paths {
+			for _, template := range expandSpecPath(p) {
+				if strings.Contains(template, "{") {
+					templated[template] = true
+				} else {
+					constant[template] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	constantTemplates := keys(constant)
+	sort.Strings(constantTemplates)
+	templatedTemplates := keys(templated)
+	sort.Slice(templatedTemplates, func(i, j int) bool {
+		a, b := asRegexp(templatedTemplates[i]), asRegexp(templatedTemplates[j])
+		if a != b {
+			return a < b
+		}
+		return templatedTemplates[i] < templatedTemplates[j]
+	})
+	return append(constantTemplates, templatedTemplates...), nil
+}
+
+func keys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// asRegexp returns the regular expression that a template used to be matched
+// with, which is what the generated templates are sorted by.
+func asRegexp(template string) string {
+	return paramPattern.ReplaceAllString(template, "[^/]*")
+}
+
+// expandSpecPath returns the endpoint templates that a path in a spec is
+// served under. Like scripts/generate_proxy_paths.py this ignores the basePath
+// of the spec: every path is served under r0 and the prefix used before r0,
+// either in the media API or the client-server API.
+func expandSpecPath(path string) []string {
+	r0 := "/_matrix/client/r0" + path
+	legacy := "/_matrix/client/api/v1" + path
+	for _, mediaPath := range mediaPaths {
+		if strings.HasPrefix(path, mediaPath) {
+			r0 = "/_matrix/media/r0" + path
+			legacy = "/_matrix/media/api/v1" + path
+		}
+	}
+	for _, v2AlphaPath := range v2AlphaPaths {
+		if strings.HasPrefix(path, v2AlphaPath) {
+			legacy = "/_matrix/client/v2_alpha" + path
+		}
+	}
+	return []string{r0, legacy}
+}
+
+// readJSONSpec returns the paths in a swagger JSON spec.
+func readJSONSpec(r io.Reader) ([]string, error) {
+	var spec struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(r).Decode(&spec); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for p := range spec.Paths {
+		if strings.HasPrefix(p, "/") {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// readYAMLSpec returns the paths in a swagger YAML spec. Rather than parsing
+// the YAML fully it only looks at the keys one level under the top level
+// "paths" key, which is all of the structure the specs in matrix-doc have that
+// we need.
+func readYAMLSpec(r io.Reader) ([]string, error) {
+	var (
+		paths       []string
+		inPaths     bool
+		pathsIndent int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		if indent == 0 {
+			key, _ := splitYAMLKey(trimmed)
+			inPaths = key == "paths"
+			pathsIndent = 0
+			continue
+		}
+		if !inPaths {
+			continue
+		}
+		if pathsIndent == 0 {
+			pathsIndent = indent
+		}
+		if indent != pathsIndent {
+			continue
+		}
+		if key, _ := splitYAMLKey(trimmed); strings.HasPrefix(key, "/") {
+			paths = append(paths, key)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// splitYAMLKey splits a simple "key: value" YAML line, removing any quotes.
+func splitYAMLKey(line string) (key, value string) {
+	if strings.HasPrefix(line, `"`) || strings.HasPrefix(line, `'`) {
+		if end := strings.IndexByte(line[1:], line[0]); end >= 0 {
+			key = line[1 : end+1]
+			line = line[end+2:]
+		}
+	} else if i := strings.IndexByte(line, ':'); i >= 0 {
+		key = line[:i]
+		line = line[i:]
+	}
+	if !strings.HasPrefix(line, ":") {
+		return "", ""
+	}
+	value = strings.TrimSpace(line[1:])
+	value = strings.Trim(value, `"'`)
+	return key, value
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+const matrixDocDir = "../../../../../vendor/src/github.com/matrix-org/matrix-doc"
+
+func TestReadSpecs(t *testing.T) {
+	templates, err := readSpecs(matrixDocDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The specs should give exactly the endpoints generated into paths.go.
+	if got, want := strings.Join(templates, "\n"), strings.Join(endpointTemplates, "\n"); got != want {
+		t.Errorf("templates from specs differ from endpointTemplates:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	trie := newEndpointTrie(templates)
+	for path, want := range map[string]string{
+		"/_matrix/client/r0/rooms/!a:b/send/m.room.message/1":   "/_matrix/client/r0/rooms/_/send/_/_",
+		"/_matrix/client/api/v1/rooms/!a:b/messages":            "/_matrix/client/api/v1/rooms/_/messages",
+		"/_matrix/client/v2_alpha/sync":                         "/_matrix/client/v2_alpha/sync",
+		"/_matrix/client/r0/users/@a:b":                         "/_matrix/client/r0/users/_",
+		"/_matrix/client/r0/presence/list/@a:b":                 "/_matrix/client/r0/presence/list/_",
+		"/_matrix/client/r0/presence/list/status":               "/_matrix/client/r0/presence/_/status",
+		"/_matrix/client/r0/lookup":                             "/_matrix/client/r0/lookup",
+		"/_matrix/media/r0/download/example.com/abc":            "/_matrix/media/r0/download/_/_",
+		"/_matrix/media/api/v1/thumbnail/example.com/abc":       "/_matrix/media/api/v1/thumbnail/_/_",
+		"/_matrix/client/r0/rooms/!a:b/state/m.room.name/state": "/_matrix/client/r0/rooms/_/state/_/_",
+	} {
+		if got := trie.lookup(path); got != want {
+			t.Errorf("lookup(%q): want %q got %q", path, want, got)
+		}
+	}
+}
+
+func TestReadYAMLSpec(t *testing.T) {
+	spec := `# A comment
+swagger: '2.0'
+basePath: "/_matrix/client/%CLIENT_MAJOR_VERSION%"
+paths:
+  "/rooms/{roomId}/ban":
+    post:
+      parameters:
+        - in: path
+  '/sync':
+    get: {}
+  /createRoom:
+    post: {}
+definitions:
+  "/not/a/path":
+    type: object
+`
+	paths, err := readYAMLSpec(strings.NewReader(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/rooms/{roomId}/ban", "/sync", "/createRoom"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("paths: want %v got %v", want, paths)
+	}
+}
+
+func TestExpandSpecPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/createRoom", []string{"/_matrix/client/r0/createRoom", "/_matrix/client/api/v1/createRoom"}},
+		{"/sync", []string{"/_matrix/client/r0/sync", "/_matrix/client/v2_alpha/sync"}},
+		{"/upload", []string{"/_matrix/media/r0/upload", "/_matrix/media/api/v1/upload"}},
+		{"/users/{userId}", []string{"/_matrix/client/r0/users/{userId}", "/_matrix/client/v2_alpha/users/{userId}"}},
+		{"/notify", []string{"/_matrix/client/r0/notify", "/_matrix/client/api/v1/notify"}},
+	} {
+		if got := expandSpecPath(tc.path); strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("expandSpecPath(%q): want %v got %v", tc.path, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var unknownPath = "unknown path"
+
+// endpoints always contains the *endpointTrie used to classify request paths.
+var endpoints atomic.Value
+
+func init() {
+	rebuildEndpoints()
+}
+
+func setEndpoints(t *endpointTrie) {
+	endpoints.Store(t)
+}
+
+func endpointFor(path string) string {
+	return endpoints.Load().(*endpointTrie).lookup(path)
+}
+
+// paramPattern matches a path parameter in an endpoint template.
+var paramPattern = regexp.MustCompile(`{[^}]*}`)
+
+// endpointName is the name that an endpoint is reported under in metrics.
+// Path parameters are replaced with "_" so that the names don't contain
+// anything specific to a user or room.
+func endpointName(template string) string {
+	return paramPattern.ReplaceAllString(template, "_")
+}
+
+// isParam returns whether a segment of an endpoint template is a parameter.
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// An endpointTrie classifies request paths by the endpoint template they
+// match. Each level of the trie is a "/" separated segment of the path.
+//
+// The trie is built so that a path is matched by following a single branch
+// from the root, so a lookup takes time proportional to the number of segments
+// in the path regardless of how many endpoints there are. To do this the
+// children of a parameter node are merged into each of its literal siblings
+// so that taking the literal branch never misses a match that would have been
+// found through the parameter.
+type endpointTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	// literals are the children for specific path segments.
+	literals map[string]*trieNode
+	// param is the child for any path segment, or nil.
+	param *trieNode
+	// endpoint is the name of the endpoint that ends at this node, if any.
+	endpoint string
+	// priority is the position of the endpoint in the list of templates.
+	// If more than one template matches a path then the lowest priority wins.
+	priority int
+}
+
+func (n *trieNode) hasEndpoint() bool {
+	return n.endpoint != ""
+}
+
+// newEndpointTrie builds a trie from a list of endpoint templates. When more
+// than one template matches a path, templates without parameters take
+// precedence, followed by the templates listed earlier.
+func newEndpointTrie(templates []string) *endpointTrie {
+	root := &trieNode{}
+	for i, template := range templates {
+		n := root
+		constant := true
+		for _, segment := range strings.Split(template, "/") {
+			n = n.child(segment)
+			constant = constant && !isParam(segment)
+		}
+		priority := i
+		if constant {
+			priority -= len(templates)
+		}
+		if !n.hasEndpoint() || priority < n.priority {
+			n.endpoint = endpointName(template)
+			n.priority = priority
+		}
+	}
+	root.flatten()
+	return &endpointTrie{root: root}
+}
+
+// child returns the child for a template segment, creating it if necessary.
+func (n *trieNode) child(segment string) *trieNode {
+	if isParam(segment) {
+		if n.param == nil {
+			n.param = &trieNode{}
+		}
+		return n.param
+	}
+	if n.literals == nil {
+		n.literals = make(map[string]*trieNode)
+	}
+	c := n.literals[segment]
+	if c == nil {
+		c = &trieNode{}
+		n.literals[segment] = c
+	}
+	return c
+}
+
+// flatten merges the subtree under the param child into every literal child
+// so that lookups never need to backtrack.
+func (n *trieNode) flatten() {
+	if n.param != nil {
+		for segment, c := range n.literals {
+			n.literals[segment] = merge(c, n.param)
+		}
+		n.param.flatten()
+	}
+	for _, c := range n.literals {
+		c.flatten()
+	}
+}
+
+// merge returns a new subtree that matches everything matched by either a or b.
+// Neither a nor b is modified.
+func merge(a, b *trieNode) *trieNode {
+	if a == nil {
+		return b.copy()
+	}
+	if b == nil {
+		return a.copy()
+	}
+	m := &trieNode{}
+	switch {
+	case a.hasEndpoint() && (!b.hasEndpoint() || a.priority < b.priority):
+		m.endpoint, m.priority = a.endpoint, a.priority
+	case b.hasEndpoint():
+		m.endpoint, m.priority = b.endpoint, b.priority
+	}
+	if len(a.literals) > 0 || len(b.literals) > 0 {
+		m.literals = make(map[string]*trieNode)
+		for segment, c := range a.literals {
+			m.literals[segment] = merge(c, b.literals[segment])
+		}
+		for segment, c := range b.literals {
+			if _, ok := a.literals[segment]; !ok {
+				m.literals[segment] = c.copy()
+			}
+		}
+	}
+	if a.param != nil || b.param != nil {
+		m.param = merge(a.param, b.param)
+	}
+	return m
+}
+
+func (n *trieNode) copy() *trieNode {
+	if n == nil {
+		return nil
+	}
+	c := &trieNode{endpoint: n.endpoint, priority: n.priority, param: n.param.copy()}
+	if n.literals != nil {
+		c.literals = make(map[string]*trieNode, len(n.literals))
+		for segment, l := range n.literals {
+			c.literals[segment] = l.copy()
+		}
+	}
+	return c
+}
+
+// lookup returns the name of the endpoint that path matches, or unknownPath.
+func (t *endpointTrie) lookup(path string) string {
+	n := t.root
+	for {
+		i := strings.IndexByte(path, '/')
+		segment := path
+		if i >= 0 {
+			segment = path[:i]
+		}
+		next := n.literals[segment]
+		if next == nil {
+			next = n.param
+		}
+		if next == nil {
+			return unknownPath
+		}
+		n = next
+		if i < 0 {
+			break
+		}
+		path = path[i+1:]
+	}
+	if !n.hasEndpoint() {
+		return unknownPath
+	}
+	return n.endpoint
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// regexpClassifier is how endpoints were classified before the trie: the
+// constant paths are looked up in a map then every templated path is tried
+// as a regular expression in order.
+type regexpClassifier struct {
+	constant map[string]bool
+	patterns []*regexp.Regexp
+	names    []string
+}
+
+func newRegexpClassifier(templates []string) *regexpClassifier {
+	c := &regexpClassifier{constant: make(map[string]bool)}
+	for _, template := range templates {
+		if !strings.Contains(template, "{") {
+			c.constant[template] = true
+			continue
+		}
+		pattern := "^" + paramPattern.ReplaceAllString(template, "[^/]*") + "$"
+		c.patterns = append(c.patterns, regexp.MustCompile(pattern))
+		c.names = append(c.names, endpointName(template))
+	}
+	return c
+}
+
+func (c *regexpClassifier) lookup(path string) string {
+	if c.constant[path] {
+		return path
+	}
+	for i, re := range c.patterns {
+		if re.MatchString(path) {
+			return c.names[i]
+		}
+	}
+	return unknownPath
+}
+
+var testPaths = []string{
+	"/_matrix/client/r0/sync",
+	"/_matrix/client/r0/rooms/!abc:example.com/send/m.room.message/txn1",
+	"/_matrix/client/r0/rooms/!abc:example.com/state/m.room.name/",
+	"/_matrix/client/r0/rooms//state",
+	"/_matrix/client/r0/presence/list/status",
+	"/_matrix/client/r0/presence/@alice:example.com/status",
+	"/_matrix/client/r0/pushrules/",
+	"/_matrix/client/r0/pushrules/global/content/rule/actions",
+	"/_matrix/client/api/v1/rooms/!abc:example.com/invite ",
+	"/_matrix/client/v2_alpha/user/@alice:example.com/filter/1",
+	"/_matrix/media/r0/download/example.com/abcdef/file.png",
+	"/_matrix/media/r0/thumbnail/example.com/abcdef",
+	"/_matrix/client/r0/rooms/!abc:example.com/unknown",
+	"/_matrix/federation/v1/send/1234",
+	"/",
+	"",
+}
+
+func TestEndpointForMatchesRegexps(t *testing.T) {
+	c := newRegexpClassifier(knownEndpoints())
+	paths := append([]string{}, testPaths...)
+	for _, template := range knownEndpoints() {
+		paths = append(paths,
+			template,
+			paramPattern.ReplaceAllString(template, "x"),
+			paramPattern.ReplaceAllString(template, ""),
+			paramPattern.ReplaceAllString(template, "list"),
+			paramPattern.ReplaceAllString(template, "x")+"/",
+		)
+	}
+	for _, path := range paths {
+		if want, got := c.lookup(path), endpointFor(path); want != got {
+			t.Errorf("endpointFor(%q): want %q got %q", path, want, got)
+		}
+	}
+}
+
+func TestEndpointTriePrecedence(t *testing.T) {
+	trie := newEndpointTrie([]string{
+		"/a/{x}/c",
+		"/a/b/{y}",
+		"/a/b/d",
+	})
+	for path, want := range map[string]string{
+		"/a/b/c": "/a/_/c",
+		"/a/b/d": "/a/b/d",
+		"/a/z/c": "/a/_/c",
+		"/a/b/z": "/a/b/_",
+		"/a/z/d": unknownPath,
+	} {
+		if got := trie.lookup(path); got != want {
+			t.Errorf("lookup(%q): want %q got %q", path, want, got)
+		}
+	}
+}
+
+func BenchmarkEndpointForTrie(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		endpointFor(testPaths[i%len(testPaths)])
+	}
+}
+
+func BenchmarkEndpointForRegexps(b *testing.B) {
+	c := newRegexpClassifier(knownEndpoints())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.lookup(testPaths[i%len(testPaths)])
+	}
+}
@@ -0,0 +1,358 @@
+// Package proxyprotocol implements the server side of the HAProxy PROXY
+// protocol, versions 1 and 2, which TCP load balancers use to tell the server
+// the addresses of the client's connection.
+// See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the longest a version 1 header can be, including the CRLF.
+const v1MaxLength = 107
+
+// ErrNoHeader is returned when reading from a connection that didn't start
+// with a PROXY protocol header on a strict Listener.
+var ErrNoHeader = errors.New("proxyprotocol: connection did not start with a PROXY header")
+
+// ErrUntrusted is returned when reading from a connection from a peer that
+// isn't trusted to send PROXY headers on a strict Listener.
+var ErrUntrusted = errors.New("proxyprotocol: connection is not from a trusted proxy")
+
+// A Listener wraps a net.Listener so that the RemoteAddr and LocalAddr of the
+// connections it accepts are the addresses given in their PROXY protocol
+// header rather than the addresses of the load balancer's connection.
+//
+// The header is read when the connection is first used rather than in Accept
+// so that a slow peer doesn't stop other connections from being accepted.
+// It implements prometheus.Collector to export the number of connections
+// accepted by whether they had a header.
+type Listener struct {
+	net.Listener
+	// Strict listeners close connections that don't start with a header.
+	// Otherwise those connections are passed through unchanged.
+	Strict bool
+	// Trusted reports whether a peer may send a PROXY header. Headers from
+	// other peers are not parsed.
+	Trusted func(net.IP) bool
+	// HeaderTimeout limits how long to wait for the header to arrive.
+	HeaderTimeout time.Duration
+
+	connections *prometheus.CounterVec
+}
+
+// NewListener wraps inner so that it reads PROXY protocol headers sent by
+// trusted peers.
+func NewListener(inner net.Listener, strict bool, trusted func(net.IP) bool) *Listener {
+	return &Listener{
+		Listener:      inner,
+		Strict:        strict,
+		Trusted:       trusted,
+		HeaderTimeout: 10 * time.Second,
+		connections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_proxy_protocol_connections_total",
+				Help: "Number of connections accepted by whether they started with a valid PROXY protocol header",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+// Accept implements net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, listener: l, reader: bufio.NewReader(c)}, nil
+}
+
+// Describe implements prometheus.Collector
+func (l *Listener) Describe(ch chan<- *prometheus.Desc) {
+	l.connections.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Listener) Collect(ch chan<- prometheus.Metric) {
+	l.connections.Collect(ch)
+}
+
+// A Conn is a connection accepted by a Listener.
+type Conn struct {
+	net.Conn
+	listener *Listener
+	reader   *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+}
+
+// Read implements net.Conn
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// Write implements net.Conn
+func (c *Conn) Write(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+// RemoteAddr returns the address of the client given in the PROXY header, or
+// the address of the peer if there wasn't one.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// PeerAddr returns the address of the peer that made the connection, which is
+// the load balancer if it sent a PROXY header. Unlike RemoteAddr it doesn't
+// wait for the header.
+func (c *Conn) PeerAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to given in the PROXY
+// header, or the local address of the connection if there wasn't one.
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline implements net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) readHeader() {
+	result := "none"
+	defer func() {
+		c.listener.connections.WithLabelValues(result).Inc()
+	}()
+
+	peer := c.Conn.RemoteAddr()
+	if !c.isTrusted(peer) {
+		if c.listener.Strict {
+			result = "untrusted"
+			c.fail(ErrUntrusted, peer)
+		}
+		return
+	}
+
+	if c.listener.HeaderTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.listener.HeaderTimeout))
+		defer func() {
+			// Restore any deadline set by the caller before the header was read.
+			c.deadlineMutex.Lock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+			c.deadlineMutex.Unlock()
+		}()
+	}
+
+	src, dst, err := readHeader(c.reader)
+	switch {
+	case err == io.EOF:
+		// The peer closed the connection without sending anything.
+		result = "closed"
+		c.err = err
+	case err == errNotProxy && !c.listener.Strict:
+		return
+	case err == errNotProxy:
+		result = "missing"
+		c.fail(ErrNoHeader, peer)
+	case err != nil:
+		result = "invalid"
+		c.fail(err, peer)
+	case src == nil:
+		// A LOCAL or UNKNOWN header means the connection is from the proxy
+		// itself, e.g. a health check, so the real addresses are used.
+		result = "local"
+	default:
+		result = "proxied"
+		c.remoteAddr, c.localAddr = src, dst
+	}
+}
+
+func (c *Conn) isTrusted(addr net.Addr) bool {
+	if c.listener.Trusted == nil {
+		return true
+	}
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return c.listener.Trusted(addr.IP)
+	case *net.UnixAddr:
+		// Only local processes allowed by the socket's permissions can
+		// connect to a unix socket.
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Conn) fail(err error, peer net.Addr) {
+	log.WithFields(log.Fields{
+		"peer":  peer.String(),
+		"error": err,
+	}).Print("Rejecting PROXY protocol connection")
+	c.err = err
+	c.Conn.Close()
+}
+
+// errNotProxy is returned by readHeader if the connection didn't start with
+// a PROXY protocol signature. Nothing is consumed from the reader.
+var errNotProxy = errors.New("proxyprotocol: no header")
+
+// readHeader reads a version 1 or 2 PROXY header from r and returns the
+// source and destination addresses in it. The addresses are nil if the
+// header didn't include them.
+func readHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// Peek one byte at a time so that we don't block waiting for more bytes
+	// than a client that isn't using the PROXY protocol will send.
+	for i := 1; i <= len(v2Signature); i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		isV1 := i <= len(v1Prefix) && bytes.HasPrefix(v1Prefix, b)
+		isV2 := bytes.HasPrefix(v2Signature, b)
+		if !isV1 && !isV2 {
+			return nil, nil, errNotProxy
+		}
+		if isV1 && i == len(v1Prefix) {
+			return readV1(r)
+		}
+	}
+	return readV2(r)
+}
+
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return parseV1(string(line[:len(line)-2]))
+		}
+	}
+	return nil, nil, errors.New("proxyprotocol: version 1 header too long")
+}
+
+func parseV1(line string) (src, dst net.Addr, err error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("proxyprotocol: invalid version 1 header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("proxyprotocol: invalid version 1 header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// The signature is followed by the version and command, the address
+	// family and protocol, and the length of the rest of the header.
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxyprotocol: unsupported version %d", verCmd>>4)
+	}
+	switch verCmd & 0xF {
+	case 0x0:
+		// LOCAL
+		return nil, nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, nil, fmt.Errorf("proxyprotocol: unsupported command %d", verCmd&0xF)
+	}
+	switch family {
+	case 0x11, 0x12:
+		// TCP or UDP over IPv4
+		if len(body) < 12 {
+			return nil, nil, errors.New("proxyprotocol: short IPv4 address block")
+		}
+		return v2Addrs(body[0:4], body[4:8], body[8:12])
+	case 0x21, 0x22:
+		// TCP or UDP over IPv6
+		if len(body) < 36 {
+			return nil, nil, errors.New("proxyprotocol: short IPv6 address block")
+		}
+		return v2Addrs(body[0:16], body[16:32], body[32:36])
+	default:
+		// Unix sockets or an unspecified family, so there are no addresses
+		// we can use.
+		return nil, nil, nil
+	}
+}
+
+func v2Addrs(srcIP, dstIP, ports []byte) (src, dst net.Addr, err error) {
+	src = &net.TCPAddr{IP: net.IP(srcIP), Port: int(binary.BigEndian.Uint16(ports[0:2]))}
+	dst = &net.TCPAddr{IP: net.IP(dstIP), Port: int(binary.BigEndian.Uint16(ports[2:4]))}
+	return src, dst, nil
+}
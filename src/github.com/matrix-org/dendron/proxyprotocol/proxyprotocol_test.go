@@ -0,0 +1,111 @@
+package proxyprotocol
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// accept sends data to a Listener wrapping a local TCP listener and returns
+// the accepted connection along with everything read from it.
+func accept(t *testing.T, strict bool, data string) (net.Conn, string, error) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	l := NewListener(inner, strict, nil)
+
+	go func() {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte(data))
+		c.Close()
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	body, err := ioutil.ReadAll(c)
+	return c, string(body), err
+}
+
+func TestV1(t *testing.T) {
+	c, body, err := accept(t, true, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET / HTTP/1.1\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr: want 192.0.2.1:56324 got %s", got)
+	}
+	if got := c.LocalAddr().String(); got != "198.51.100.2:443" {
+		t.Errorf("LocalAddr: want 198.51.100.2:443 got %s", got)
+	}
+	if body != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+func TestV1Unknown(t *testing.T) {
+	c, body, err := accept(t, true, "PROXY UNKNOWN\r\nhello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("RemoteAddr: want the peer address got %s", got)
+	}
+	if body != "hello" {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+func TestV2(t *testing.T) {
+	header := string(v2Signature) +
+		"\x21" + // version 2, PROXY
+		"\x21" + // TCP over IPv6
+		"\x00\x28" + // 36 bytes of addresses and a 4 byte TLV
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\x30\x39\x01\xbb" +
+		"\x04\x00\x01\x00"
+	c, body, err := accept(t, true, header+"hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "[2001:db8::1]:12345" {
+		t.Errorf("RemoteAddr: want [2001:db8::1]:12345 got %s", got)
+	}
+	if got := c.LocalAddr().String(); got != "[2001:db8::2]:443" {
+		t.Errorf("LocalAddr: want [2001:db8::2]:443 got %s", got)
+	}
+	if body != "hello" {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	c, body, err := accept(t, false, "GET / HTTP/1.1\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("RemoteAddr: want the peer address got %s", got)
+	}
+	if body != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("body: got %q", body)
+	}
+
+	if _, _, err := accept(t, true, "GET / HTTP/1.1\r\n\r\n"); err != ErrNoHeader {
+		t.Errorf("strict: want ErrNoHeader got %v", err)
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	if _, _, err := accept(t, false, "PROXY TCP4 not-an-ip 198.51.100.2 1 2\r\n"); err == nil {
+		t.Error("want error for invalid header")
+	}
+}
@@ -0,0 +1,231 @@
+// Package quota limits how much media each user can upload, per day and in
+// total.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendron/auth"
+	"github.com/matrix-org/dendron/proxy"
+)
+
+// Quotas are the most bytes a user may upload. Zero means no limit.
+type Quotas struct {
+	// Daily is per UTC day.
+	Daily int64
+	// Total is over all time.
+	Total int64
+	// MaxUpload is the largest upload allowed, which is reserved against
+	// the quotas while an upload of unknown length is in progress.
+	MaxUpload int64
+}
+
+// A Limiter counts the bytes each user uploads and refuses uploads from
+// users over their quota.
+// It implements prometheus.Collector to export uploads and refusals.
+type Limiter struct {
+	quotas Quotas
+	store  *Store
+	userID func(token string) (string, error)
+	now    func() time.Time
+
+	uploaded prometheus.Counter
+	exceeded *prometheus.CounterVec
+}
+
+// NewLimiter creates a Limiter that enforces quotas, counting in store and
+// looking up the users that access tokens belong to with userID.
+func NewLimiter(quotas Quotas, store *Store, userID func(token string) (string, error)) *Limiter {
+	return &Limiter{
+		quotas: quotas,
+		store:  store,
+		userID: userID,
+		now:    time.Now,
+		uploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dendron_uploaded_bytes_total",
+			Help: "Number of bytes of media successfully uploaded by users",
+		}),
+		exceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_upload_quota_exceeded_total",
+				Help: "Number of uploads refused because the user was over their daily or total quota",
+			},
+			[]string{"quota"},
+		),
+	}
+}
+
+func (l *Limiter) day() string {
+	return l.now().UTC().Format("2006-01-02")
+}
+
+// user returns the user that made req, or "" if it isn't known.
+func (l *Limiter) user(req *http.Request) string {
+	if userID, ok := auth.VerifiedUserID(req); ok {
+		return userID
+	}
+	if token := auth.AccessToken(req); token != "" && l.userID != nil {
+		if userID, err := l.userID(token); err == nil {
+			return userID
+		}
+	}
+	return ""
+}
+
+// exceeds returns which quota an upload of size bytes would put usage over,
+// or "" if neither. Uploads of unknown size are refused only once the user
+// has reached their quota.
+func (l *Limiter) exceeds(usage Usage, size int64) string {
+	if size < 0 {
+		size = 1
+	}
+	if l.quotas.Daily > 0 && usage.DayBytes+size > l.quotas.Daily {
+		return "daily"
+	}
+	if l.quotas.Total > 0 && usage.Total+size > l.quotas.Total {
+		return "total"
+	}
+	return ""
+}
+
+// Handler wraps next so that uploads from users over their quota are refused
+// with M_RESOURCE_LIMIT_EXCEEDED, and the bytes of successful uploads are
+// counted against the user. The length of an upload, or MaxUpload if it isn't
+// known, is reserved against the user's quota while it is in progress. Uploads
+// without a known user are left for synapse to refuse.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if (req.Method != "POST" && req.Method != "PUT") || !proxy.UploadPath.MatchString(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		userID := l.user(req)
+		if userID == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		day := l.day()
+		reserved := req.ContentLength
+		if reserved < 0 {
+			reserved = l.quotas.MaxUpload
+		}
+		quota := l.store.Reserve(userID, day, reserved, func(usage Usage) string {
+			return l.exceeds(usage, req.ContentLength)
+		})
+		if quota != "" {
+			l.exceeded.WithLabelValues(quota).Inc()
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        fmt.Errorf("%s upload quota exceeded by %s", quota, userID),
+				StatusCode: 403,
+				ErrCode:    "M_RESOURCE_LIMIT_EXCEEDED",
+				Message:    "Upload quota exceeded",
+			})
+			return
+		}
+
+		body := &proxy.CountingReader{ReadCloser: req.Body}
+		req.Body = body
+		recorder := &proxy.StatusRecorder{ResponseWriter: w}
+		// The reservation is settled even if the proxy panics to abort
+		// the response.
+		completed := false
+		defer func() {
+			status := recorder.Status
+			if status == 0 && completed {
+				// Nothing was written so net/http will send an empty 200.
+				status = http.StatusOK
+			}
+			var uploaded int64
+			if status == http.StatusOK {
+				uploaded = body.Count()
+				l.uploaded.Add(float64(uploaded))
+			}
+			if err := l.store.Settle(userID, day, reserved, uploaded); err != nil {
+				log.WithFields(log.Fields{
+					"userID": userID,
+					"error":  err,
+				}).Error("Failed to record upload")
+			}
+		}()
+		next.ServeHTTP(recorder, req)
+		completed = true
+	})
+}
+
+// AdminHandler serves the admin API for quotas under prefix:
+//
+//	GET    prefix           lists the usage of every user
+//	GET    prefix/{userId}  shows a user's usage
+//	DELETE prefix/{userId}  resets a user's usage
+func (l *Limiter) AdminHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userID, err := url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(req.URL.EscapedPath(), prefix), "/"))
+		switch {
+		case err != nil:
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        err,
+				StatusCode: 400,
+				ErrCode:    "M_INVALID_PARAM",
+				Message:    "Invalid user ID",
+			})
+		case userID == "" && req.Method == "GET":
+			proxy.SetHeaders(w)
+			json.NewEncoder(w).Encode(struct {
+				Usage []Usage `json:"usage"`
+			}{l.store.All()})
+		case userID != "" && req.Method == "GET":
+			proxy.SetHeaders(w)
+			json.NewEncoder(w).Encode(l.store.Usage(userID, l.day()))
+		case userID != "" && req.Method == "DELETE":
+			found, err := l.store.Reset(userID)
+			if err != nil {
+				proxy.LogAndReplyError(w, &proxy.HTTPError{
+					Err:        err,
+					StatusCode: 500,
+					ErrCode:    "M_UNKNOWN",
+					Message:    "Internal server error",
+				})
+				return
+			}
+			if !found {
+				proxy.LogAndReplyError(w, &proxy.HTTPError{
+					Err:        fmt.Errorf("no uploads by %q", userID),
+					StatusCode: 404,
+					ErrCode:    "M_NOT_FOUND",
+					Message:    "No uploads by that user",
+				})
+				return
+			}
+			log.WithField("userID", userID).Info("Reset upload quota")
+			proxy.SetHeaders(w)
+			w.Write([]byte("{}"))
+		default:
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        fmt.Errorf("unsupported %s %s", req.Method, req.URL.Path),
+				StatusCode: 405,
+				ErrCode:    "M_UNRECOGNIZED",
+				Message:    "Unrecognized request",
+			})
+		}
+	})
+}
+
+// Describe implements prometheus.Collector
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.uploaded.Describe(ch)
+	l.exceeded.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.uploaded.Collect(ch)
+	l.exceeded.Collect(ch)
+}
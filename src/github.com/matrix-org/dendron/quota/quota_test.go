@@ -0,0 +1,198 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func users(token string) (string, error) {
+	if token == "alice_token" {
+		return "@alice:example.org", nil
+	}
+	return "", errors.New("unknown token")
+}
+
+func tempStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "uploads.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestLimiter(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+	store, err := OpenStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	l := NewLimiter(Quotas{Daily: 100, Total: 150}, store, users)
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	status := 200
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.WriteHeader(status)
+	}))
+	upload := func(size int, chunked bool) int {
+		req := httptest.NewRequest("POST", "/_matrix/media/r0/upload", strings.NewReader(strings.Repeat("x", size)))
+		req.Header.Set("Authorization", "Bearer alice_token")
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code == 403 && !strings.Contains(w.Body.String(), "M_RESOURCE_LIMIT_EXCEEDED") {
+			t.Errorf("want M_RESOURCE_LIMIT_EXCEEDED got %s", w.Body)
+		}
+		return w.Code
+	}
+
+	if code := upload(60, false); code != 200 {
+		t.Fatalf("first upload: want 200 got %d", code)
+	}
+	if code := upload(60, false); code != 403 {
+		t.Errorf("over the daily quota: want 403 got %d", code)
+	}
+	status = 500
+	upload(30, false)
+	status = 200
+	// Chunked uploads are allowed until the quota is reached.
+	if code := upload(50, true); code != 200 {
+		t.Errorf("chunked upload: want 200 got %d", code)
+	}
+	if u := store.Usage("@alice:example.org", "2017-03-01"); u.DayBytes != 110 || u.Total != 110 {
+		t.Errorf("failed uploads mustn't count: got %+v", u)
+	}
+	if code := upload(1, true); code != 403 {
+		t.Errorf("chunked upload over quota: want 403 got %d", code)
+	}
+
+	// The daily quota resets the next day, but not the total.
+	now = now.Add(24 * time.Hour)
+	if code := upload(40, false); code != 200 {
+		t.Errorf("next day: want 200 got %d", code)
+	}
+	if code := upload(1, false); code != 403 {
+		t.Errorf("over the total quota: want 403 got %d", code)
+	}
+
+	// The usage survives a restart.
+	store.Close()
+	store, err = OpenStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if u := store.Usage("@alice:example.org", "2017-03-02"); u.DayBytes != 40 || u.Total != 150 {
+		t.Errorf("reopened: got %+v", u)
+	}
+}
+
+func TestLimiterReservesUploads(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+	store, err := OpenStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	l := NewLimiter(Quotas{Daily: 100, MaxUpload: 80}, store, users)
+	started, finish := make(chan struct{}), make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("wait") != "" {
+			started <- struct{}{}
+			<-finish
+		}
+		ioutil.ReadAll(req.Body)
+	}))
+	upload := func(size int, chunked bool, query string) int {
+		req := httptest.NewRequest("POST", "/_matrix/media/r0/upload"+query, strings.NewReader(strings.Repeat("x", size)))
+		req.Header.Set("Authorization", "Bearer alice_token")
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, chunked := range []bool{false, true} {
+		done := make(chan int)
+		go func() { done <- upload(20, chunked, "?wait=1") }()
+		<-started
+		// The upload in progress holds its length, or the largest upload
+		// if its length isn't known, against the quota.
+		if code := upload(50, false, ""); chunked && code != 403 || !chunked && code != 200 {
+			t.Errorf("chunked %v: concurrent upload got %d", chunked, code)
+		}
+		close(finish)
+		if code := <-done; code != 200 {
+			t.Errorf("chunked %v: want 200 got %d", chunked, code)
+		}
+		finish = make(chan struct{})
+		if chunked {
+			// Once settled only the bytes actually uploaded count.
+			if u := store.Usage("@alice:example.org", l.day()); u.DayBytes != 90 || store.reserved["@alice:example.org"] != 0 {
+				t.Errorf("settled: want 90 bytes and no reservation got %+v %v", u, store.reserved)
+			}
+		}
+	}
+	if code := upload(50, false, ""); code != 403 {
+		t.Errorf("over the quota: want 403 got %d", code)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+	store, err := OpenStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	l := NewLimiter(Quotas{Daily: 100}, store, users)
+	store.Add("@alice:example.org", l.day(), 42)
+	admin := l.AdminHandler("/_dendron/admin/upload_quotas")
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/_dendron/admin/upload_quotas/%40alice%3Aexample.org", nil))
+	var u Usage
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.UserID != "@alice:example.org" || u.DayBytes != 42 || u.Total != 42 {
+		t.Errorf("unexpected usage %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/_dendron/admin/upload_quotas/@alice:example.org", nil))
+	if w.Code != 200 {
+		t.Errorf("reset: want 200 got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/_dendron/admin/upload_quotas", nil))
+	if w.Body.String() != "{\"usage\":[]}\n" {
+		t.Errorf("want no usage got %s", w.Body)
+	}
+
+	// Resets are kept across restarts too.
+	store.Close()
+	if store, err = OpenStore(path, false); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if all := store.All(); len(all) != 0 {
+		t.Errorf("reopened: want no usage got %+v", all)
+	}
+}
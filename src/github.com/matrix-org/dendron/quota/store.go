@@ -0,0 +1,251 @@
+package quota
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A record is a line in a Store's log. It either adds Bytes uploaded on Day,
+// or if Set is true replaces the user's usage.
+type record struct {
+	User     string `json:"user"`
+	Day      string `json:"day"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Set      bool   `json:"set,omitempty"`
+	Total    int64  `json:"total,omitempty"`
+	DayBytes int64  `json:"day_bytes,omitempty"`
+}
+
+// Usage is how much a user has uploaded.
+type Usage struct {
+	UserID string `json:"user_id"`
+	// Total is the bytes uploaded ever.
+	Total int64 `json:"total_bytes"`
+	// Day is the UTC date, as YYYY-MM-DD, of the user's last upload.
+	Day string `json:"day"`
+	// DayBytes is the bytes uploaded on Day.
+	DayBytes int64 `json:"day_bytes"`
+}
+
+// apply updates u with r.
+func (u *Usage) apply(r record) {
+	if r.Set {
+		u.Total, u.Day, u.DayBytes = r.Total, r.Day, r.DayBytes
+		return
+	}
+	u.Total += r.Bytes
+	switch {
+	case r.Day == u.Day:
+		u.DayBytes += r.Bytes
+	case r.Day > u.Day:
+		u.Day, u.DayBytes = r.Day, r.Bytes
+	}
+}
+
+// A Store keeps users' upload usage in an append-only log file, so that it
+// survives restarts and two dendrons can share it during a hand-off.
+// Uploads in progress hold reservations which aren't written to the log.
+type Store struct {
+	path     string
+	mutex    sync.Mutex
+	file     *os.File
+	usage    map[string]*Usage
+	reserved map[string]int64
+}
+
+// OpenStore opens the log at path, creating it if needed. If compact is set
+// the log is first rewritten with one line per user. That mustn't be done
+// while another dendron is using it.
+func OpenStore(path string, compact bool) (*Store, error) {
+	s := &Store{path: path, usage: make(map[string]*Usage), reserved: make(map[string]int64)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if compact {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// A partly written last line is lost, rather than the rest.
+			continue
+		}
+		if r.User == "" {
+			return fmt.Errorf("quota: %s:%d: record without a user", s.path, line)
+		}
+		if r.Set && r.Total == 0 && r.DayBytes == 0 {
+			delete(s.usage, r.User)
+			continue
+		}
+		s.get(r.User).apply(r)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log with the current usage.
+func (s *Store) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, u := range s.usage {
+		if err = writeRecord(w, setRecord(u)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func setRecord(u *Usage) record {
+	return record{User: u.UserID, Set: true, Total: u.Total, Day: u.Day, DayBytes: u.DayBytes}
+}
+
+func writeRecord(w io.Writer, r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// One write per line so that appends from two processes don't mix.
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// get returns the usage for userID, creating it if needed. The mutex must be
+// held if the store is open.
+func (s *Store) get(userID string) *Usage {
+	u, ok := s.usage[userID]
+	if !ok {
+		u = &Usage{UserID: userID}
+		s.usage[userID] = u
+	}
+	return u
+}
+
+// Usage returns the usage of userID, with DayBytes counting uploads on day.
+func (s *Store) Usage(userID, day string) Usage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.usageOn(userID, day)
+}
+
+// usageOn returns the usage of userID on day. The mutex must be held.
+func (s *Store) usageOn(userID, day string) Usage {
+	u, ok := s.usage[userID]
+	if !ok {
+		return Usage{UserID: userID, Day: day}
+	}
+	usage := *u
+	if usage.Day != day {
+		usage.Day, usage.DayBytes = day, 0
+	}
+	return usage
+}
+
+// All returns the usage of every user, sorted by user ID.
+func (s *Store) All() []Usage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	all := make([]Usage, 0, len(s.usage))
+	for _, u := range s.usage {
+		all = append(all, *u)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].UserID < all[j].UserID })
+	return all
+}
+
+// Reserve holds bytes against userID's usage while an upload is in progress,
+// so that concurrent uploads can't together go over a quota. Before reserving
+// it calls exceeds with the usage on day, counting other reservations, and if
+// that returns a quota then nothing is reserved and the quota is returned.
+func (s *Store) Reserve(userID, day string, bytes int64, exceeds func(Usage) string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	usage := s.usageOn(userID, day)
+	usage.Total += s.reserved[userID]
+	usage.DayBytes += s.reserved[userID]
+	if quota := exceeds(usage); quota != "" {
+		return quota
+	}
+	s.reserved[userID] += bytes
+	return ""
+}
+
+// Settle releases a reservation of reserved bytes made with Reserve and
+// records that userID actually uploaded bytes on day.
+func (s *Store) Settle(userID, day string, reserved, bytes int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reserved[userID] -= reserved; s.reserved[userID] <= 0 {
+		delete(s.reserved, userID)
+	}
+	if bytes <= 0 {
+		return nil
+	}
+	r := record{User: userID, Day: day, Bytes: bytes}
+	s.get(userID).apply(r)
+	return writeRecord(s.file, r)
+}
+
+// Add records that userID uploaded bytes on day.
+func (s *Store) Add(userID, day string, bytes int64) error {
+	r := record{User: userID, Day: day, Bytes: bytes}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.get(userID).apply(r)
+	return writeRecord(s.file, r)
+}
+
+// Reset forgets userID's usage and returns whether there was any.
+func (s *Store) Reset(userID string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.usage[userID]; !ok {
+		return false, nil
+	}
+	delete(s.usage, userID)
+	return true, writeRecord(s.file, record{User: userID, Set: true})
+}
+
+// Close closes the log.
+func (s *Store) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,269 @@
+// Package ratelimit limits how often a user or client IP can make expensive
+// requests, so that floods of them are turned away before they reach synapse.
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendron/auth"
+	"github.com/matrix-org/dendron/clientip"
+	"github.com/matrix-org/dendron/proxy"
+)
+
+// bucketsPerClass is how many users and IPs are tracked for each class.
+// Buckets for the least recently seen are forgotten, which resets their limit.
+const bucketsPerClass = 100000
+
+// A class is a group of endpoints that share a rate limit.
+type class struct {
+	name   string
+	method string
+	path   *regexp.Regexp
+}
+
+// classes are the groups of endpoints that can be limited, checked in order.
+var classes = []class{
+	{"register", "POST", proxy.ClientPath(`register$`)},
+	{"login", "POST", proxy.ClientPath(`login$`)},
+	{"createRoom", "POST", proxy.ClientPath(`createRoom$`)},
+	{"join", "POST", proxy.ClientPath(`(join/[^/]+|rooms/[^/]+/join)$`)},
+	{"invite", "POST", proxy.ClientPath(`rooms/[^/]+/invite$`)},
+	{"send", "PUT", proxy.ClientPath(`rooms/[^/]+/(send|state|redact)/`)},
+	{"upload", "POST", proxy.UploadPath},
+}
+
+// classFor returns the name of the class of req, or "" if it isn't in one.
+func classFor(req *http.Request) string {
+	for _, c := range classes {
+		if req.Method == c.method && c.path.MatchString(req.URL.Path) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// A Limit allows Burst requests at once, refilled at Rate per second.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+// ParseLimits parses a comma separated list of limits for classes in the form
+// "class=rate:burst", e.g. "createRoom=0.1:5,send=10:50".
+func ParseLimits(value string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.FieldsFunc(entry, func(r rune) bool { return r == '=' || r == ':' })
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("ratelimit: invalid limit %q, want class=rate:burst", entry)
+		}
+		known := false
+		for _, c := range classes {
+			known = known || c.name == parts[0]
+		}
+		if !known {
+			return nil, fmt.Errorf("ratelimit: unknown class %q", parts[0])
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("ratelimit: invalid rate in %q", entry)
+		}
+		burst, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("ratelimit: invalid burst in %q", entry)
+		}
+		limits[parts[0]] = Limit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// A bucket holds the tokens for one user or IP in a class.
+type bucket struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket if there is one. Otherwise it returns
+// how long until there will be.
+func (b *bucket) take(limit Limit, now time.Time) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.last.IsZero() {
+		b.tokens = limit.Burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > limit.Burst {
+			b.tokens = limit.Burst
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// A Limiter applies token bucket rate limits to classes of requests. Requests
+// with an access token are limited by the user it belongs to, and others by
+// the client's IP address.
+// It implements prometheus.Collector to export how many requests were limited.
+type Limiter struct {
+	limits  map[string]Limit
+	buckets map[string]*lru.Cache
+	userID  func(token string) (string, error)
+
+	exemptUsers []*regexp.Regexp
+	exemptIPs   []*net.IPNet
+
+	mutex   sync.Mutex
+	limited *prometheus.CounterVec
+	now     func() time.Time
+}
+
+// NewLimiter creates a Limiter which applies limits, looking up the users
+// that access tokens belong to with userID.
+// Requests from users matching one of the exemptUsers regular expressions,
+// such as an appservice's namespace, or from IPs in one of the exemptIPs
+// ranges aren't limited.
+func NewLimiter(limits map[string]Limit, userID func(token string) (string, error), exemptUsers, exemptIPs []string) (*Limiter, error) {
+	l := &Limiter{
+		limits:  limits,
+		buckets: make(map[string]*lru.Cache),
+		userID:  userID,
+		limited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_rate_limited_requests_total",
+				Help: "Number of requests refused because they were over the rate limit for their class",
+			},
+			[]string{"class", "key"},
+		),
+		now: time.Now,
+	}
+	for name := range limits {
+		cache, err := lru.New(bucketsPerClass)
+		if err != nil {
+			return nil, err
+		}
+		l.buckets[name] = cache
+	}
+	for _, pattern := range exemptUsers {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: invalid exempt user pattern %q: %v", pattern, err)
+		}
+		l.exemptUsers = append(l.exemptUsers, re)
+	}
+	var err error
+	if l.exemptIPs, err = clientip.ParseNetworks(exemptIPs); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// key returns the key to limit req by and whether it is "user" or "ip", or ""
+// if req is exempt.
+func (l *Limiter) key(req *http.Request) (string, string) {
+	ip := clientip.FromRequest(req)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, ipNet := range l.exemptIPs {
+			if ipNet.Contains(parsed) {
+				return "", ""
+			}
+		}
+	}
+	userID, ok := auth.VerifiedUserID(req)
+	if token := auth.AccessToken(req); !ok && token != "" && l.userID != nil {
+		// If the token can't be resolved the request is limited by IP
+		// and synapse rejects it if the token is bad.
+		if resolved, err := l.userID(token); err == nil {
+			userID, ok = resolved, true
+		}
+	}
+	if !ok {
+		return "ip:" + ip, "ip"
+	}
+	for _, re := range l.exemptUsers {
+		if re.MatchString(userID) {
+			return "", ""
+		}
+	}
+	return "user:" + userID, "user"
+}
+
+// allow returns whether req is within its limit, and if not how long until it
+// would be.
+func (l *Limiter) allow(req *http.Request) (bool, string, time.Duration) {
+	name := classFor(req)
+	limit, ok := l.limits[name]
+	if !ok {
+		return true, name, 0
+	}
+	key, keyType := l.key(req)
+	if key == "" {
+		return true, name, 0
+	}
+
+	cache := l.buckets[name]
+	l.mutex.Lock()
+	value, ok := cache.Get(key)
+	if !ok {
+		value = &bucket{}
+		cache.Add(key, value)
+	}
+	l.mutex.Unlock()
+
+	allowed, retryAfter := value.(*bucket).take(limit, l.now())
+	if !allowed {
+		l.limited.WithLabelValues(name, keyType).Inc()
+	}
+	return allowed, name, retryAfter
+}
+
+// Handler wraps next so that requests over their limit are refused with
+// M_LIMIT_EXCEEDED. It must be wrapped by a clientip.Resolver's Handler so
+// that the client IP is known.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		allowed, name, retryAfter := l.allow(req)
+		if !allowed {
+			proxy.LogAndReplyError(w, &proxy.HTTPError{
+				Err:        fmt.Errorf("rate limit exceeded for %s", name),
+				StatusCode: 429,
+				ErrCode:    "M_LIMIT_EXCEEDED",
+				Message:    "Too many requests",
+				RetryAfter: retryAfter,
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Describe implements prometheus.Collector
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.limited.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.limited.Collect(ch)
+}
@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func users(token string) (string, error) {
+	switch token {
+	case "alice_token":
+		return "@alice:example.org", nil
+	case "bob_token":
+		return "@bob:example.org", nil
+	case "irc_token":
+		return "@_irc_bridge:example.org", nil
+	}
+	return "", errors.New("unknown token")
+}
+
+func TestLimiter(t *testing.T) {
+	limits, err := ParseLimits("createRoom=1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLimiter(limits, users, []string{"@_irc_.*:example.org"}, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	request := func(method, path, token, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	createRoom := "/_matrix/client/r0/createRoom"
+
+	for i := 0; i < 2; i++ {
+		if w := request("POST", createRoom, "alice_token", "203.0.113.1:1"); w.Code != 200 {
+			t.Fatalf("request %d within the burst: got %d", i, w.Code)
+		}
+	}
+	w := request("POST", createRoom, "alice_token", "203.0.113.2:1")
+	if w.Code != 429 {
+		t.Fatalf("over the limit: want 429 got %d", w.Code)
+	}
+	var body struct {
+		ErrCode      string `json:"errcode"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ErrCode != "M_LIMIT_EXCEEDED" || body.RetryAfterMs != 1000 {
+		t.Errorf("want M_LIMIT_EXCEEDED with retry_after_ms 1000 got %s", w.Body)
+	}
+
+	// Limits are per user, and other classes aren't limited.
+	if w := request("POST", createRoom, "bob_token", "203.0.113.1:1"); w.Code != 200 {
+		t.Errorf("another user: want 200 got %d", w.Code)
+	}
+	if w := request("PUT", "/_matrix/client/r0/rooms/!a:b/send/m.room.message/1", "alice_token", "203.0.113.1:1"); w.Code != 200 {
+		t.Errorf("unlimited class: want 200 got %d", w.Code)
+	}
+
+	// Exempt users and IPs.
+	for i := 0; i < 5; i++ {
+		if w := request("POST", createRoom, "irc_token", "203.0.113.1:1"); w.Code != 200 {
+			t.Errorf("exempt user: want 200 got %d", w.Code)
+		}
+		if w := request("POST", createRoom, "alice_token", "10.1.1.1:1"); w.Code != 200 {
+			t.Errorf("exempt IP: want 200 got %d", w.Code)
+		}
+	}
+
+	// Requests without a valid token are limited by IP.
+	for i := 0; i < 2; i++ {
+		request("POST", createRoom, "bad_token", "198.51.100.1:1")
+	}
+	if w := request("POST", createRoom, "", "198.51.100.1:1"); w.Code != 429 {
+		t.Errorf("over the IP limit: want 429 got %d", w.Code)
+	}
+
+	// The bucket refills over time.
+	now = now.Add(time.Second)
+	if w := request("POST", createRoom, "alice_token", "203.0.113.1:1"); w.Code != 200 {
+		t.Errorf("after refilling: want 200 got %d", w.Code)
+	}
+}
+
+func TestClassFor(t *testing.T) {
+	for _, tc := range []struct {
+		method, path, want string
+	}{
+		{"POST", "/_matrix/client/r0/createRoom", "createRoom"},
+		{"POST", "/_matrix/client/api/v1/createRoom", "createRoom"},
+		{"POST", "/_matrix/client/v3/rooms/!a:b/join", "join"},
+		{"POST", "/_matrix/client/api/v1/join/#a:b", "join"},
+		{"POST", "/_matrix/client/api/v1/rooms/!a:b/invite", "invite"},
+		{"PUT", "/_matrix/client/api/v1/rooms/!a:b/send/m.room.message/1", "send"},
+		{"POST", "/_matrix/client/api/v1/login", "login"},
+		{"POST", "/_matrix/media/api/v1/upload", "upload"},
+		{"GET", "/_matrix/client/api/v1/createRoom", ""},
+		{"POST", "/_matrix/client/api/v2/createRoom", ""},
+	} {
+		if got := classFor(httptest.NewRequest(tc.method, tc.path, nil)); got != tc.want {
+			t.Errorf("%s %s: want class %q got %q", tc.method, tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits("createRoom=0.1:5, send=10:50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["createRoom"] != (Limit{0.1, 5}) || limits["send"] != (Limit{10, 50}) {
+		t.Errorf("got %v", limits)
+	}
+	for _, value := range []string{"nope=1:1", "send=1", "send=0:1", "send=1:0.5", "send=x:1"} {
+		if _, err := ParseLimits(value); err == nil {
+			t.Errorf("%q: want error", value)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package systemd implements the parts of the systemd service protocol that
+// dendron uses: inheriting listening sockets through socket activation and
+// telling the service manager about its state through sd_notify.
+// See sd_listen_fds(3) and sd_notify(3).
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// Listeners returns the listening sockets passed to dendron by systemd socket
+// activation, or nil if it wasn't socket activated.
+// The environment variables describing the sockets are removed so that they
+// aren't inherited by the processes that dendron starts.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	return fileListeners(listenFDsStart, count)
+}
+
+// fileListeners returns listeners for count file descriptors starting at first.
+func fileListeners(first, count int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, count)
+	for fd := first; fd < first+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		l, err := net.FileListener(file)
+		// FileListener dups the descriptor so the original is no longer needed.
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited file descriptor %d: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// A Notifier sends state changes to the service manager. Its methods do
+// nothing if dendron wasn't started by a service manager that asked for them.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// NewNotifier creates a Notifier from the NOTIFY_SOCKET and WATCHDOG_USEC
+// environment variables, then removes them so that the processes dendron
+// starts don't send their own notifications on its behalf.
+func NewNotifier() *Notifier {
+	n := &Notifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid, pidErr := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+	if err == nil && usec > 0 && (pidErr != nil || pid == os.Getpid()) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	return n
+}
+
+// Notify sends the given "KEY=value" assignments to the service manager.
+func (n *Notifier) Notify(state ...string) error {
+	if n.socket == "" {
+		return nil
+	}
+	addr := &net.UnixAddr{Net: "unixgram", Name: n.socket}
+	if strings.HasPrefix(addr.Name, "@") {
+		// A leading "@" names a socket in the abstract namespace.
+		addr.Name = "\x00" + addr.Name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+// Status tells the service manager what dendron is doing.
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// Ready tells the service manager that dendron has started up.
+func (n *Notifier) Ready(status string) error {
+	return n.Notify("READY=1", "STATUS="+status)
+}
+
+// Stopping tells the service manager that dendron is shutting down.
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// MainPID tells the service manager that another process has taken over as
+// the main process of the service.
+func (n *Notifier) MainPID(pid int) error {
+	return n.Notify(fmt.Sprintf("MAINPID=%d", pid))
+}
+
+// Environ returns the environment variables that a new dendron taking over
+// from this one needs to send its own notifications.
+func (n *Notifier) Environ() []string {
+	var env []string
+	if n.socket != "" {
+		env = append(env, "NOTIFY_SOCKET="+n.socket)
+	}
+	if n.watchdog > 0 {
+		env = append(env, fmt.Sprintf("WATCHDOG_USEC=%d", n.watchdog/time.Microsecond))
+	}
+	return env
+}
+
+// WatchdogInterval returns how often the service manager expects watchdog
+// pings, or zero if the watchdog isn't enabled.
+func (n *Notifier) WatchdogInterval() time.Duration {
+	return n.watchdog
+}
+
+// Watchdog pings the service manager's watchdog at half the interval it
+// expects until stop is closed. It returns immediately if the watchdog isn't
+// enabled.
+func (n *Notifier) Watchdog(stop <-chan struct{}) {
+	if n.watchdog <= 0 {
+		return
+	}
+	ticker := time.NewTicker(n.watchdog / 2)
+	defer ticker.Stop()
+	for {
+		n.Notify("WATCHDOG=1")
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens on a unixgram socket, points NOTIFY_SOCKET at it
+// and returns the socket so the test can read what was sent.
+func fakeNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram", Name: path})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifier(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+
+	n := NewNotifier()
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Error("want NOTIFY_SOCKET removed from the environment")
+	}
+
+	for _, tc := range []struct {
+		send func() error
+		want string
+	}{
+		{func() error { return n.Status("Starting synapse") }, "STATUS=Starting synapse"},
+		{func() error { return n.Ready("Serving requests") }, "READY=1\nSTATUS=Serving requests"},
+		{n.Stopping, "STOPPING=1"},
+	} {
+		if err := tc.send(); err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(t, conn); got != tc.want {
+			t.Errorf("want %q got %q", tc.want, got)
+		}
+	}
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := NewNotifier().Ready("Serving requests"); err != nil {
+		t.Errorf("want no error without NOTIFY_SOCKET got %v", err)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+	os.Setenv("WATCHDOG_USEC", "20000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	n := NewNotifier()
+	if n.WatchdogInterval() != 20*time.Millisecond {
+		t.Fatalf("want a 20ms watchdog interval got %v", n.WatchdogInterval())
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		n.Watchdog(stop)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		if got := receive(t, conn); got != "WATCHDOG=1" {
+			t.Errorf("want WATCHDOG=1 got %q", got)
+		}
+	}
+	close(stop)
+	<-done
+
+	os.Setenv("WATCHDOG_USEC", "20000")
+	os.Setenv("WATCHDOG_PID", "1")
+	if NewNotifier().WatchdogInterval() != 0 {
+		t.Error("want the watchdog disabled for another process")
+	}
+}
+
+func TestFileListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file is closed by fileListeners so take a copy of the descriptor.
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := fileListeners(fd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+	if got, want := listeners[0].Addr().String(), l.Addr().String(); got != want {
+		t.Errorf("want a listener on %s got %s", want, got)
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	if err != nil || listeners != nil {
+		t.Errorf("want no listeners for another process got %v, %v", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("want LISTEN_FDS removed from the environment")
+	}
+}
@@ -0,0 +1,33 @@
+package tlspolicy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendron/proxy"
+)
+
+// RequireClientCert wraps next so that requests for paths starting with one of
+// prefixes are refused unless the connection they were made on presented a
+// client certificate that was verified.
+func RequireClientCert(prefixes []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, prefix := range prefixes {
+			if !strings.HasPrefix(req.URL.Path, prefix) {
+				continue
+			}
+			if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+				proxy.LogAndReplyError(w, &proxy.HTTPError{
+					Err:        fmt.Errorf("no client certificate for %s", req.URL.Path),
+					StatusCode: 403,
+					ErrCode:    "M_FORBIDDEN",
+					Message:    "A client certificate is required",
+				})
+				return
+			}
+			break
+		}
+		next.ServeHTTP(w, req)
+	})
+}
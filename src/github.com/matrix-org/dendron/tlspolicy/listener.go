@@ -0,0 +1,171 @@
+package tlspolicy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Listener is like the listener returned by tls.NewListener except that it
+// completes the handshake before returning a connection from Accept, so that
+// it can count the handshakes that fail by why they failed.
+// The handshakes happen in their own goroutines so a slow client doesn't stop
+// other connections from being accepted.
+// It implements prometheus.Collector to export the handshake counts.
+type Listener struct {
+	inner  net.Listener
+	config *tls.Config
+	// HandshakeTimeout limits how long a client has to complete the handshake.
+	HandshakeTimeout time.Duration
+
+	conns     chan *tls.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	handshakes *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+}
+
+// NewListener creates a Listener that accepts connections from inner and
+// serves TLS on them with config.
+func NewListener(inner net.Listener, config *tls.Config) *Listener {
+	l := &Listener{
+		inner:            inner,
+		config:           config,
+		HandshakeTimeout: 10 * time.Second,
+		conns:            make(chan *tls.Conn),
+		done:             make(chan struct{}),
+		handshakes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_tls_handshakes_total",
+				Help: "Number of successful TLS handshakes by TLS version",
+			},
+			[]string{"version"},
+		),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dendron_tls_handshake_failures_total",
+				Help: "Number of failed TLS handshakes by reason",
+			},
+			[]string{"reason"},
+		),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.inner.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			l.Close()
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *Listener) handshake(c net.Conn) {
+	tlsConn := tls.Server(c, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), l.HandshakeTimeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		l.failures.WithLabelValues(failureReason(err)).Inc()
+		c.Close()
+		return
+	}
+	l.handshakes.WithLabelValues(tls.VersionName(tlsConn.ConnectionState().Version)).Inc()
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Accept returns the next connection that has completed its handshake.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, errors.New("tlspolicy: listener closed")
+	}
+}
+
+// Close implements net.Listener
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.inner.Close()
+	})
+	return err
+}
+
+// Addr implements net.Listener
+func (l *Listener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// failureReason classifies a handshake error for metrics.
+func failureReason(err error) string {
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var netErr net.Error
+	msg := err.Error()
+	switch {
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCert):
+		return "bad_client_certificate"
+	case strings.Contains(msg, "didn't provide a certificate"):
+		return "missing_client_certificate"
+	case strings.Contains(msg, "remote error"):
+		// The client sent an alert, usually because it didn't accept our
+		// certificate.
+		return "client_alert"
+	case strings.Contains(msg, "unsupported versions"):
+		return "version"
+	case strings.Contains(msg, "no cipher suite"):
+		return "cipher_suite"
+	case strings.Contains(msg, "no ECDHE curve") || strings.Contains(msg, "no mutually supported group"):
+		return "curve"
+	default:
+		return "other"
+	}
+}
+
+// Describe implements prometheus.Collector
+func (l *Listener) Describe(ch chan<- *prometheus.Desc) {
+	l.handshakes.Describe(ch)
+	l.failures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Listener) Collect(ch chan<- prometheus.Metric) {
+	l.handshakes.Collect(ch)
+	l.failures.Collect(ch)
+}
@@ -0,0 +1,153 @@
+// Package tlspolicy configures the TLS versions, cipher suites, curves,
+// session tickets and client certificate checks that dendron's listener uses,
+// and counts the TLS handshakes that fail.
+package tlspolicy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Options are the policy for a TLS listener. The zero value leaves Go's
+// defaults in place.
+type Options struct {
+	// MinVersion is the lowest TLS version accepted, e.g. "1.2".
+	MinVersion string
+	// CipherSuites are the names of the cipher suites used for TLS 1.2 and
+	// below, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". The TLS 1.3
+	// suites aren't configurable.
+	CipherSuites []string
+	// Curves are the names of the key exchanges in order of preference,
+	// e.g. "X25519".
+	Curves []string
+	// DisableSessionTickets turns off session resumption with tickets.
+	DisableSessionTickets bool
+	// ClientAuth is "request" to verify client certificates if they are
+	// given, or "require" to refuse connections without one. Client
+	// certificates aren't asked for if it is empty.
+	ClientAuth string
+	// ClientCAFile is a PEM bundle of the CAs that client certificates must
+	// be signed by.
+	ClientCAFile string
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// Apply sets the fields of config from opts.
+func Apply(config *tls.Config, opts Options) error {
+	if opts.MinVersion != "" {
+		version, ok := versions[opts.MinVersion]
+		if !ok {
+			return fmt.Errorf("tlspolicy: unknown TLS version %q", opts.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(opts.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		config.CipherSuites = nil
+		for _, name := range opts.CipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return fmt.Errorf("tlspolicy: unknown cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	if len(opts.Curves) > 0 {
+		config.CurvePreferences = nil
+		for _, name := range opts.Curves {
+			curve, ok := curves[strings.TrimSpace(name)]
+			if !ok {
+				return fmt.Errorf("tlspolicy: unknown curve %q", name)
+			}
+			config.CurvePreferences = append(config.CurvePreferences, curve)
+		}
+	}
+
+	config.SessionTicketsDisabled = opts.DisableSessionTickets
+
+	switch opts.ClientAuth {
+	case "":
+		if opts.ClientCAFile != "" {
+			return fmt.Errorf("tlspolicy: a client CA file was given without client authentication")
+		}
+		return nil
+	case "request":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("tlspolicy: unknown client authentication mode %q", opts.ClientAuth)
+	}
+	if opts.ClientCAFile == "" {
+		return fmt.Errorf("tlspolicy: client authentication needs a client CA file")
+	}
+	pemCerts, err := ioutil.ReadFile(opts.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pemCerts) {
+		return fmt.Errorf("tlspolicy: no certificates in %s", opts.ClientCAFile)
+	}
+	return nil
+}
+
+// RotateTicketKeys replaces the session ticket key of config every interval
+// until stop is closed. The previous key is kept for decrypting tickets so
+// that a session can be resumed for between one and two intervals.
+func RotateTicketKeys(config *tls.Config, interval time.Duration, stop <-chan struct{}) error {
+	var keys [][32]byte
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > 2 {
+			keys = keys[:2]
+		}
+		config.SetSessionTicketKeys(keys)
+		return nil
+	}
+	if err := rotate(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// rand.Read doesn't fail on the platforms we run on.
+				rotate()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
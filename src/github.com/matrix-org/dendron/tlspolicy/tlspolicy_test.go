@@ -0,0 +1,194 @@
+package tlspolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newCert creates a certificate for name signed by parent, or self-signed if
+// parent is nil.
+func newCert(t *testing.T, name string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeCA(t *testing.T, ca tls.Certificate) string {
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	return f.Name()
+}
+
+func TestApply(t *testing.T) {
+	config := &tls.Config{}
+	err := Apply(config, Options{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"X25519", "P256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion: want TLS 1.2 got %x", config.MinVersion)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("CipherSuites: got %v", config.CipherSuites)
+	}
+	if len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.X25519 {
+		t.Errorf("CurvePreferences: got %v", config.CurvePreferences)
+	}
+
+	for _, opts := range []Options{
+		{MinVersion: "2.0"},
+		{CipherSuites: []string{"TLS_MADE_UP"}},
+		{Curves: []string{"P123"}},
+		{ClientAuth: "require"},
+		{ClientAuth: "sometimes", ClientCAFile: "ca.pem"},
+		{ClientCAFile: "ca.pem"},
+	} {
+		if err := Apply(&tls.Config{}, opts); err == nil {
+			t.Errorf("%+v: want error", opts)
+		}
+	}
+}
+
+func failures(l *Listener, reason string) float64 {
+	var m dto.Metric
+	l.failures.WithLabelValues(reason).Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func TestListener(t *testing.T) {
+	ca := newCert(t, "ca", true, nil)
+	caFile := writeCA(t, ca)
+	defer os.Remove(caFile)
+	server := newCert(t, "example.org", false, &ca)
+	client := newCert(t, "client", false, &ca)
+
+	config := &tls.Config{Certificates: []tls.Certificate{server}}
+	if err := Apply(config, Options{ClientAuth: "require", ClientCAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, config)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	dial := func(certs []tls.Certificate) error {
+		c, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{
+			RootCAs: roots, ServerName: "example.org", Certificates: certs,
+		})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = ioutil.ReadAll(c)
+		return err
+	}
+
+	if err := dial([]tls.Certificate{client}); err != nil {
+		t.Errorf("with a client certificate: %v", err)
+	}
+	if err := dial(nil); err == nil {
+		t.Error("without a client certificate: want error")
+	}
+	c, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	ioutil.ReadAll(c)
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for failures(l, "missing_client_certificate") != 1 || failures(l, "not_tls") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want one missing_client_certificate and one not_tls failure got %v and %v",
+				failures(l, "missing_client_certificate"), failures(l, "not_tls"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	h := RequireClientCert([]string{"/_synapse/admin/"}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		path     string
+		verified bool
+		want     int
+	}{
+		{"/_matrix/client/r0/sync", false, 200},
+		{"/_synapse/admin/v1/purge_history", false, 403},
+		{"/_synapse/admin/v1/purge_history", true, 200},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.verified {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s verified=%v: want %d got %d", tc.path, tc.verified, tc.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connStats counts the connections to an upstream and how requests to it got
+// their connections.
+type connStats struct {
+	reused uint64
+	fresh  uint64
+
+	open    int64
+	active  int64
+	waiting int64
+}
+
+// track counts conn as open until it is closed.
+func (s *connStats) track(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&s.open, 1)
+	return &trackedConn{Conn: conn, stats: s}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+// Close implements net.Conn
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.stats.open, -1) })
+	return c.Conn.Close()
+}
+
+// The stages of a request for connection metrics.
+const (
+	stageWaiting int32 = iota
+	stageActive
+	stageDone
+)
+
+// trackingTransport wraps a transport to count the requests that are waiting
+// for a connection or using one, and whether each request was sent on a new
+// connection or one reused from an earlier request.
+type trackingTransport struct {
+	inner *http.Transport
+	stats *connStats
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stage := stageWaiting
+	atomic.AddInt64(&t.stats.waiting, 1)
+	done := func() {
+		if atomic.CompareAndSwapInt32(&stage, stageWaiting, stageDone) {
+			atomic.AddInt64(&t.stats.waiting, -1)
+		} else if atomic.CompareAndSwapInt32(&stage, stageActive, stageDone) {
+			atomic.AddInt64(&t.stats.active, -1)
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if atomic.CompareAndSwapInt32(&stage, stageWaiting, stageActive) {
+				atomic.AddInt64(&t.stats.waiting, -1)
+				atomic.AddInt64(&t.stats.active, 1)
+			}
+			if info.Reused {
+				atomic.AddUint64(&t.stats.reused, 1)
+			} else {
+				atomic.AddUint64(&t.stats.fresh, 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	// The connection is in use until the body has been read and closed.
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// The body of a 101 Switching Protocols response is the connection,
+		// which httputil.ReverseProxy needs to be able to write to.
+		resp.Body = &trackedReadWriteCloser{rwc, &onClose{done: done}}
+	} else {
+		resp.Body = &trackedBody{resp.Body, &onClose{done: done}}
+	}
+	return resp, nil
+}
+
+type onClose struct {
+	once sync.Once
+	done func()
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	onClose *onClose
+}
+
+func (b *trackedBody) Close() error {
+	b.onClose.once.Do(b.onClose.done)
+	return b.ReadCloser.Close()
+}
+
+type trackedReadWriteCloser struct {
+	io.ReadWriteCloser
+	onClose *onClose
+}
+
+func (b *trackedReadWriteCloser) Close() error {
+	b.onClose.once.Do(b.onClose.done)
+	return b.ReadWriteCloser.Close()
+}
+
+var (
+	connectionsDesc = prometheus.NewDesc(
+		"dendron_backend_connections_total",
+		"Number of requests to each backend by whether they were sent on a new or a reused connection",
+		[]string{"pool", "backend", "connection"}, nil,
+	)
+	openDesc = prometheus.NewDesc(
+		"dendron_backend_open_connections",
+		"Number of connections open to each backend",
+		[]string{"pool", "backend"}, nil,
+	)
+	idleDesc = prometheus.NewDesc(
+		"dendron_backend_idle_connections",
+		"Number of open connections to each backend that aren't being used by a request. "+
+			"Backends that use HTTP/2 can serve several requests on a connection, so this is zero while they are busy",
+		[]string{"pool", "backend"}, nil,
+	)
+	waitingDesc = prometheus.NewDesc(
+		"dendron_backend_waiting_requests",
+		"Number of requests to each backend waiting for a connection",
+		[]string{"pool", "backend"}, nil,
+	)
+)
+
+type pooledUpstream struct {
+	pool     string
+	upstream *Upstream
+}
+
+// Metrics exports how dendron's connections to its upstreams are used.
+// It implements prometheus.Collector.
+type Metrics struct {
+	mutex     sync.Mutex
+	upstreams []pooledUpstream
+}
+
+// NewMetrics creates a Metrics for no upstreams.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Add exports the metrics for u, labelled as being in pool.
+func (m *Metrics) Add(pool string, u *Upstream) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.upstreams = append(m.upstreams, pooledUpstream{pool, u})
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionsDesc
+	ch <- openDesc
+	ch <- idleDesc
+	ch <- waitingDesc
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, pu := range m.upstreams {
+		stats := pu.upstream.stats
+		labels := []string{pu.pool, pu.upstream.Name}
+		ch <- prometheus.MustNewConstMetric(
+			connectionsDesc, prometheus.CounterValue,
+			float64(atomic.LoadUint64(&stats.fresh)), append(labels, "new")...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			connectionsDesc, prometheus.CounterValue,
+			float64(atomic.LoadUint64(&stats.reused)), append(labels, "reused")...,
+		)
+
+		open := atomic.LoadInt64(&stats.open)
+		idle := open - atomic.LoadInt64(&stats.active)
+		if idle < 0 {
+			idle = 0
+		}
+		ch <- prometheus.MustNewConstMetric(openDesc, prometheus.GaugeValue, float64(open), labels...)
+		ch <- prometheus.MustNewConstMetric(idleDesc, prometheus.GaugeValue, float64(idle), labels...)
+		ch <- prometheus.MustNewConstMetric(
+			waitingDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&stats.waiting)), labels...,
+		)
+	}
+}
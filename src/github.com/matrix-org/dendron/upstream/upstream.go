@@ -0,0 +1,238 @@
+// Package upstream describes the synapse processes that dendron proxies
+// requests to and how to connect to them.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/matrix-org/dendron/bodylimit"
+)
+
+// unixScheme is the URL scheme for upstreams listening on a unix socket,
+// e.g. "unix:/var/run/synapse/synapse.sock".
+const unixScheme = "unix"
+
+// An Upstream is a server that dendron proxies requests to.
+type Upstream struct {
+	// URL is the base URL for requests to the upstream. For unix sockets it
+	// is an http URL whose host is a placeholder.
+	URL *url.URL
+	// Name identifies the upstream in logs and metrics. It is the host and
+	// port for TCP upstreams and the socket path for unix socket upstreams.
+	Name string
+	// Transport makes requests to the upstream.
+	Transport http.RoundTripper
+
+	rawurl string
+	stats  *connStats
+}
+
+// Options tune the pool of connections that dendron keeps to an upstream.
+type Options struct {
+	// MaxIdleConns is how many idle connections are kept open for reuse.
+	MaxIdleConns int
+	// MaxConns limits the number of connections, including those in use.
+	// Requests wait for a connection once it is reached. Zero means no limit.
+	MaxConns int
+	// IdleTimeout is how long an idle connection is kept open for.
+	IdleTimeout time.Duration
+	// KeepAlive is the interval between TCP keep-alive probes.
+	KeepAlive time.Duration
+	// DialTimeout limits how long connecting to the upstream can take.
+	DialTimeout time.Duration
+}
+
+// DefaultOptions are the same as http.DefaultTransport's, except that more
+// idle connections are kept to each upstream.
+var DefaultOptions = Options{
+	MaxIdleConns: 100,
+	IdleTimeout:  90 * time.Second,
+	KeepAlive:    30 * time.Second,
+	DialTimeout:  30 * time.Second,
+}
+
+// Parse parses the URL of an upstream. It accepts http:// and https:// URLs,
+// and unix: URLs whose path is the location of the socket. The connections
+// to it are tuned by opts.
+//
+// How to connect is configured with query parameters, which are removed from
+// the URL:
+//
+//	tls_ca           PEM bundle of the CAs to verify an https upstream with,
+//	                 instead of the system's roots.
+//	tls_cert         PEM client certificate to present to an https upstream.
+//	tls_key          The private key for tls_cert.
+//	tls_server_name  The name to verify an https upstream's certificate for,
+//	                 if it isn't the host in the URL.
+//	h2c              "true" to speak HTTP/2 without TLS to an http upstream.
+//	max_idle_conns, max_conns, idle_timeout, keepalive, dial_timeout
+//	                 override the corresponding field of opts.
+//
+// https upstreams use HTTP/2 if they offer it.
+func Parse(rawurl string, opts Options) (*Upstream, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	u.RawQuery = ""
+	if err := opts.override(query); err != nil {
+		return nil, fmt.Errorf("%s: %v", rawurl, err)
+	}
+
+	stats := &connStats{}
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return stats.track(dialer.DialContext(ctx, network, addr))
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConns,
+		MaxConnsPerHost:       opts.MaxConns,
+		IdleConnTimeout:       opts.IdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	up := &Upstream{URL: u, Name: u.Host, rawurl: rawurl, stats: stats}
+
+	switch u.Scheme {
+	case "http":
+		if h2c, _ := strconv.ParseBool(query.Get("h2c")); h2c {
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	case "https":
+		if transport.TLSClientConfig, err = tlsConfig(query); err != nil {
+			return nil, fmt.Errorf("%s: %v", rawurl, err)
+		}
+		transport.ForceAttemptHTTP2 = true
+	case unixScheme:
+		socketPath := u.Path
+		if socketPath == "" {
+			socketPath = u.Opaque
+		}
+		if socketPath == "" {
+			return nil, fmt.Errorf("missing socket path in %q", rawurl)
+		}
+		// The host is only used for the Host header of the requests that
+		// dendron makes itself, since proxied requests keep their own.
+		up.URL = &url.URL{Scheme: "http", Host: "localhost"}
+		up.Name = socketPath
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, "unix", socketPath)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme in %q", rawurl)
+	}
+
+	up.Transport = &trackingTransport{inner: transport, stats: stats}
+	return up, nil
+}
+
+// override replaces the fields of opts given as query parameters.
+func (opts *Options) override(query url.Values) error {
+	for name, value := range map[string]*int{
+		"max_idle_conns": &opts.MaxIdleConns,
+		"max_conns":      &opts.MaxConns,
+	} {
+		if s := query.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s %q", name, s)
+			}
+			*value = n
+		}
+	}
+	for name, value := range map[string]*time.Duration{
+		"idle_timeout": &opts.IdleTimeout,
+		"keepalive":    &opts.KeepAlive,
+		"dial_timeout": &opts.DialTimeout,
+	} {
+		if s := query.Get(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, s)
+			}
+			*value = d
+		}
+	}
+	return nil
+}
+
+// tlsConfig builds the TLS config for an https upstream from the tls_*
+// parameters in query.
+func tlsConfig(query url.Values) (*tls.Config, error) {
+	config := &tls.Config{ServerName: query.Get("tls_server_name")}
+	if caFile := query.Get("tls_ca"); caFile != "" {
+		pemCerts, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	certFile, keyFile := query.Get("tls_cert"), query.Get("tls_key")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("tls_cert and tls_key must be given together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// String returns the URL the upstream was configured with.
+func (u *Upstream) String() string {
+	return u.rawurl
+}
+
+// ReverseProxy returns a reverse proxy that forwards requests to the upstream.
+// Requests whose bodies are cut off by bodylimit are answered with
+// M_TOO_LARGE rather than as a failure of the upstream.
+func (u *Upstream) ReverseProxy() *httputil.ReverseProxy {
+	p := httputil.NewSingleHostReverseProxy(u.URL)
+	p.Transport = u.Transport
+	p.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			bodylimit.ReplyTooLarge(w, err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"upstream": u.Name,
+			"path":     req.URL.Path,
+		}).WithError(err).Error("Proxying request failed")
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return p
+}
+
+// Client returns an HTTP client for dendron's own requests to the upstream.
+func (u *Upstream) Client() *http.Client {
+	return &http.Client{Transport: u.Transport}
+}
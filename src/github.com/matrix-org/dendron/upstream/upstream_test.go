@@ -0,0 +1,248 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseHTTP(t *testing.T) {
+	u, err := Parse("http://localhost:18448", DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "localhost:18448" {
+		t.Errorf("Name: want localhost:18448 got %s", u.Name)
+	}
+	if u.URL.String() != "http://localhost:18448" {
+		t.Errorf("URL: want http://localhost:18448 got %s", u.URL)
+	}
+}
+
+func TestParseUnix(t *testing.T) {
+	for _, rawurl := range []string{"unix:/run/synapse.sock", "unix:///run/synapse.sock"} {
+		u, err := Parse(rawurl, DefaultOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Name != "/run/synapse.sock" {
+			t.Errorf("%s: Name: want /run/synapse.sock got %s", rawurl, u.Name)
+		}
+		if u.String() != rawurl {
+			t.Errorf("%s: String: got %s", rawurl, u.String())
+		}
+	}
+	if _, err := Parse("unix:", DefaultOptions); err == nil {
+		t.Error("want error for unix URL without a path")
+	}
+}
+
+func TestUnixRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "synapse.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	}))
+
+	u, err := Parse("unix:"+socketPath, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := u.Client().Get(u.URL.String() + "/_matrix/client/versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "/_matrix/client/versions" {
+		t.Errorf("want /_matrix/client/versions got %q", body)
+	}
+}
+
+func TestReverseProxyBodyTooLarge(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+	}))
+	defer backend.Close()
+	u, err := Parse(backend.URL, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := u.ReverseProxy()
+
+	req := httptest.NewRequest("POST", "/_matrix/media/r0/upload", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 1000))))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	req.Body = http.MaxBytesReader(w, req.Body, 100)
+	p.ServeHTTP(w, req)
+	if w.Code != 413 || !strings.Contains(w.Body.String(), "M_TOO_LARGE") {
+		t.Errorf("want 413 M_TOO_LARGE got %d %s", w.Code, w.Body)
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A client certificate for dendron, which is its own CA.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dendron"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "client.crt"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, "client.key"), "EC PRIVATE KEY", keyDER)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	s.EnableHTTP2 = true
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	s.TLS.ClientCAs.AddCert(clientCert)
+	s.StartTLS()
+	defer s.Close()
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", s.Certificate().Raw)
+
+	u, err := Parse(s.URL+"?tls_ca="+filepath.Join(dir, "ca.crt")+
+		"&tls_cert="+filepath.Join(dir, "client.crt")+"&tls_key="+filepath.Join(dir, "client.key")+
+		"&tls_server_name=example.com", DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.URL.RawQuery != "" {
+		t.Errorf("want the parameters removed from the URL got %s", u.URL)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := u.Client().Get(u.URL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "HTTP/2.0" {
+			t.Errorf("want HTTP/2.0 got %q", body)
+		}
+	}
+	if u.stats.fresh != 1 || u.stats.reused != 1 {
+		t.Errorf("want one new and one reused connection got %d and %d", u.stats.fresh, u.stats.reused)
+	}
+
+	if _, err := Parse(s.URL+"?tls_cert="+filepath.Join(dir, "client.crt"), DefaultOptions); err == nil {
+		t.Error("want error for tls_cert without tls_key")
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+
+	u, err := Parse(s.URL+"?max_conns=1&dial_timeout=5s", DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := u.Client().Get(u.URL.String())
+			if err == nil {
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	waitFor := func(what string, f func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !f() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: %+v", what, *u.stats)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("one request to wait", func() bool {
+		return atomic.LoadInt64(&u.stats.open) == 1 && atomic.LoadInt64(&u.stats.active) == 1 &&
+			atomic.LoadInt64(&u.stats.waiting) == 1
+	})
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor("the connection to be idle", func() bool {
+		return atomic.LoadInt64(&u.stats.open) == 1 && atomic.LoadInt64(&u.stats.active) == 0 &&
+			atomic.LoadInt64(&u.stats.waiting) == 0
+	})
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, rawurl := range []string{
+		"http://localhost:8008?max_conns=lots",
+		"http://localhost:8008?max_idle_conns=-1",
+		"http://localhost:8008?idle_timeout=90",
+		"ftp://localhost:8008",
+	} {
+		if _, err := Parse(rawurl, DefaultOptions); err == nil {
+			t.Errorf("%s: want error", rawurl)
+		}
+	}
+}
@@ -16,8 +16,12 @@ import (
 
 // NewHandler creates an http.Handler which serves up the client-server API versions currently served by the delegated Synapse.
 // It caches this response for updateInterval, and will serve stale cache entries if it cannot get a new value from the Synapse.
-func NewHandler(synapseURL *url.URL, updateInterval time.Duration) (*Handler, error) {
-	h := &Handler{synapseURL: synapseURL}
+// The requests to Synapse are made with client, or http.DefaultClient if it is nil.
+func NewHandler(synapseURL *url.URL, client *http.Client, updateInterval time.Duration) (*Handler, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	h := &Handler{synapseURL: synapseURL, client: client}
 	if err := h.update(); err != nil {
 		return nil, fmt.Errorf("error getting initial version: %v", err)
 	}
@@ -38,6 +42,7 @@ func NewHandler(synapseURL *url.URL, updateInterval time.Duration) (*Handler, er
 // response from synapse
 type Handler struct {
 	synapseURL *url.URL
+	client     *http.Client
 
 	resp atomic.Value // Always contains a valid []byte
 }
@@ -49,7 +54,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func (h *Handler) update() error {
 	url := h.synapseURL.String() + "/_matrix/client/versions"
-	resp, err := http.Get(url)
+	resp, err := h.client.Get(url)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"versionUrl": url,
@@ -36,7 +36,7 @@ func TestVersions(t *testing.T) {
 	defer s.Close()
 
 	u, _ := url.Parse(s.URL)
-	h, err := NewHandler(u, 25*time.Millisecond)
+	h, err := NewHandler(u, nil, 25*time.Millisecond)
 	if err != nil {
 		t.Fatal(err)
 	}